@@ -0,0 +1,51 @@
+package geoip
+
+import (
+	"errors"
+	"net"
+)
+
+// AnonymousInfo contains the anonymizer flags for an IP address,
+// as returned by LookupAnonymous. See the IsAnonymous* fields in
+// Record for their meaning.
+type AnonymousInfo struct {
+	IsAnonymous        bool
+	IsAnonymousVPN     bool
+	IsHostingProvider  bool
+	IsPublicProxy      bool
+	IsResidentialProxy bool
+	IsTorExitNode      bool
+}
+
+// LookupAnonymous returns the anonymizer flags for the given IP. It's
+// intended for GeoIP2-Anonymous-IP databases, whose records contain only
+// these flags, but it also works with GeoIP2 Enterprise databases. Since
+// Anonymous-IP databases only include anonymous networks, IPs which are
+// not found in the database return the zero AnonymousInfo and no error.
+func (g *GeoIP) LookupAnonymous(ip net.IP) (AnonymousInfo, error) {
+	db := g.current()
+	p, err := db.lookupIPPointer(ip)
+	if err != nil {
+		if errors.Is(err, errAddrNotFound) {
+			return AnonymousInfo{}, nil
+		}
+		return AnonymousInfo{}, err
+	}
+	opts := &options{fields: FieldTraits, strict: g.opts.strict}
+	val, err := db.recordValue(p, opts)
+	if err != nil {
+		return AnonymousInfo{}, err
+	}
+	rec, err := newRecord(val, opts)
+	if err != nil {
+		return AnonymousInfo{}, err
+	}
+	return AnonymousInfo{
+		IsAnonymous:        rec.IsAnonymous,
+		IsAnonymousVPN:     rec.IsAnonymousVPN,
+		IsHostingProvider:  rec.IsHostingProvider,
+		IsPublicProxy:      rec.IsPublicProxy,
+		IsResidentialProxy: rec.IsResidentialProxy,
+		IsTorExitNode:      rec.IsTorExitNode,
+	}, nil
+}
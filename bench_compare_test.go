@@ -1,3 +1,4 @@
+//go:build compare
 // +build compare
 
 package geoip
@@ -17,8 +18,9 @@ func BenchmarkLookupOschwaldMaxminddb(b *testing.B) {
 	defer db.Close()
 	b.ResetTimer()
 	ip := net.ParseIP("17.0.0.1")
+	var rec interface{}
 	for ii := 0; ii < b.N; ii++ {
-		db.Lookup(ip)
+		db.Lookup(ip, &rec)
 	}
 }
 
@@ -2,6 +2,7 @@ package geoip
 
 import (
 	"net"
+	"net/netip"
 	"testing"
 )
 
@@ -34,3 +35,50 @@ func BenchmarkLookupIPValue(b *testing.B) {
 		geo.LookupIPValue(ip)
 	}
 }
+
+func BenchmarkLookupAddr(b *testing.B) {
+	geo, err := Open("GeoLite2-City.mmdb")
+	if err != nil {
+		b.Fatal(err)
+	}
+	addr := netip.MustParseAddr("17.0.0.1")
+	b.ResetTimer()
+	for ii := 0; ii < b.N; ii++ {
+		geo.LookupAddr(addr)
+	}
+}
+
+func BenchmarkLookupCountryCode(b *testing.B) {
+	geo, err := Open("GeoLite2-City.mmdb")
+	if err != nil {
+		b.Fatal(err)
+	}
+	ip := net.ParseIP("17.0.0.1")
+	if ip == nil {
+		b.Fatal("bad ip")
+	}
+	b.ResetTimer()
+	for ii := 0; ii < b.N; ii++ {
+		geo.LookupCountryCode(ip)
+	}
+}
+
+func BenchmarkLookupInto(b *testing.B) {
+	geo, err := Open("GeoLite2-City.mmdb")
+	if err != nil {
+		b.Fatal(err)
+	}
+	ip := net.ParseIP("17.0.0.1")
+	if ip == nil {
+		b.Fatal("bad ip")
+	}
+	var rec struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	b.ResetTimer()
+	for ii := 0; ii < b.N; ii++ {
+		geo.LookupInto(ip, &rec)
+	}
+}
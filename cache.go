@@ -0,0 +1,163 @@
+package geoip
+
+import (
+	"container/list"
+	"sync"
+)
+
+// CacheStats contains the statistics of the lookup cache. See
+// LookupCache and GeoIP.LookupCacheStats.
+type CacheStats struct {
+	// Hits is the number of lookups served from the cache.
+	Hits uint64
+	// Misses is the number of lookups which had to decode
+	// the record from the database.
+	Misses uint64
+	// Size is the number of records currently cached.
+	Size int
+	// Capacity is the maximum number of cached records.
+	Capacity int
+}
+
+type cacheEntry struct {
+	ptr int
+	rec *Record
+}
+
+// lookupCache is an LRU cache of decoded records, keyed by
+// their pointer in the database. Since many networks share the
+// same record, this has a much higher hit rate than caching by
+// IP address. The cache only holds records from the database
+// with the given generation, so records decoded from a database
+// which has been replaced are never cached nor returned.
+type lookupCache struct {
+	mu         sync.Mutex
+	capacity   int
+	generation uint64
+	entries    map[int]*list.Element
+	lru        *list.List
+	hits       uint64
+	misses     uint64
+}
+
+func newLookupCache(capacity int, generation uint64) *lookupCache {
+	return &lookupCache{
+		capacity:   capacity,
+		generation: generation,
+		entries:    make(map[int]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+func (c *lookupCache) get(generation uint64, ptr int) (*Record, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		c.misses++
+		return nil, false
+	}
+	if elem, ok := c.entries[ptr]; ok {
+		c.hits++
+		c.lru.MoveToFront(elem)
+		return elem.Value.(*cacheEntry).rec, true
+	}
+	c.misses++
+	return nil, false
+}
+
+func (c *lookupCache) add(generation uint64, ptr int, rec *Record) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if elem, ok := c.entries[ptr]; ok {
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[ptr] = c.lru.PushFront(&cacheEntry{ptr: ptr, rec: rec})
+	for c.lru.Len() > c.capacity {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).ptr)
+	}
+}
+
+func (c *lookupCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[int]*list.Element)
+	c.lru.Init()
+}
+
+// reset clears the cache and makes it hold only records
+// from the database with the given generation.
+func (c *lookupCache) reset(generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation = generation
+	c.entries = make(map[int]*list.Element)
+	c.lru.Init()
+}
+
+func (c *lookupCache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Hits:     c.hits,
+		Misses:   c.misses,
+		Size:     c.lru.Len(),
+		Capacity: c.capacity,
+	}
+}
+
+// resetLookupCache clears the lookup cache after the database
+// used by g has been replaced, so it only caches records from
+// the current one.
+func (g *GeoIP) resetLookupCache() {
+	if g.cache != nil {
+		g.cache.reset(g.current().generation)
+	}
+}
+
+// ClearLookupCache removes all the records from the lookup cache
+// (see LookupCache). The cache is also cleared automatically when
+// the database is reloaded. If the cache is disabled, this is a
+// no-op.
+func (g *GeoIP) ClearLookupCache() {
+	if g.cache != nil {
+		g.cache.clear()
+	}
+}
+
+// LookupCacheStats returns the hit and miss counts and the current
+// size of the lookup cache (see LookupCache). If the cache is
+// disabled, the zero CacheStats is returned.
+func (g *GeoIP) LookupCacheStats() CacheStats {
+	if g.cache != nil {
+		return g.cache.stats()
+	}
+	return CacheStats{}
+}
+
+// recordAt returns the Record at the given pointer in db,
+// using the lookup cache if it's enabled.
+func (g *GeoIP) recordAt(db *database, ptr int) (*Record, error) {
+	if g.cache != nil {
+		if rec, ok := g.cache.get(db.generation, ptr); ok {
+			return rec.Clone(), nil
+		}
+	}
+	res, err := db.recordValue(ptr, &g.opts)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := g.resultToRecord(res)
+	if err != nil {
+		return nil, err
+	}
+	if g.cache != nil {
+		g.cache.add(db.generation, ptr, rec.Clone())
+	}
+	return rec, nil
+}
@@ -0,0 +1,108 @@
+package geoip
+
+import (
+	"net"
+	"net/netip"
+	"sort"
+)
+
+// CountryRange is a range of IP addresses, from Start to End (both
+// included), associated with a country.
+type CountryRange struct {
+	Start netip.Addr
+	End   netip.Addr
+	// ISO is the ISO 3166-1 2 letter code of the country.
+	ISO string
+}
+
+// CountryTable is a sorted list of non-overlapping CountryRange,
+// which allows looking up the country of an IP address with a
+// binary search. See BuildCountryTable.
+type CountryTable []CountryRange
+
+// BuildCountryTable walks the whole database and returns the ranges of
+// addresses associated with each country, merging adjacent ranges with
+// the same country. IPv4 ranges use 4 byte addresses, including the ones
+// stored as IPv4-mapped IPv6 networks. Looking up the returned table is
+// faster than using the database, even with LookupCountryCode, at the
+// cost of the memory used by the table, which makes it suitable for high
+// throughput geo-blocking. Networks without a country are not included.
+func (g *GeoIP) BuildCountryTable() (CountryTable, error) {
+	db := g.current()
+	var table CountryTable
+	codes := make(map[int]string)
+	err := db.walk(func(network *net.IPNet, ptr int) error {
+		code, ok := codes[ptr]
+		if !ok {
+			var err error
+			if code, err = db.countryCodeAt(ptr); err != nil {
+				return err
+			}
+			codes[ptr] = code
+		}
+		if code == "" {
+			return nil
+		}
+		start, _ := netip.AddrFromSlice(network.IP)
+		end := make(net.IP, len(network.IP))
+		for ii := range end {
+			end[ii] = network.IP[ii] | ^network.Mask[ii]
+		}
+		last, _ := netip.AddrFromSlice(end)
+		if start.Is4In6() && last.Is4In6() {
+			// IPv6 databases without an IPv4 subtree store
+			// IPv4 networks at ::ffff:0:0/96
+			start, last = start.Unmap(), last.Unmap()
+		}
+		table = append(table, CountryRange{Start: start, End: last, ISO: code})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(table, func(i, j int) bool {
+		return table[i].Start.Less(table[j].Start)
+	})
+	// Coalesce adjacent ranges
+	merged := table[:0]
+	for _, v := range table {
+		if n := len(merged); n > 0 && merged[n-1].ISO == v.ISO && merged[n-1].End.Next() == v.Start {
+			merged[n-1].End = v.End
+			continue
+		}
+		merged = append(merged, v)
+	}
+	return merged, nil
+}
+
+// Lookup returns the country code for the given IP, or the empty
+// string if it's not in the table. IPv4-mapped IPv6 addresses are
+// looked up as IPv4 addresses.
+func (t CountryTable) Lookup(ip net.IP) string {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return ""
+	}
+	return t.LookupAddr(addr)
+}
+
+// LookupAddr works like Lookup, but accepts a netip.Addr.
+func (t CountryTable) LookupAddr(addr netip.Addr) string {
+	addr = addr.Unmap()
+	if code := t.find(addr); code != "" || !addr.Is4() {
+		return code
+	}
+	// IPv4 addresses might also be in a larger IPv6 range
+	// containing ::ffff:0:0/96 (e.g. ::/64)
+	return t.find(netip.AddrFrom16(addr.As16()))
+}
+
+func (t CountryTable) find(addr netip.Addr) string {
+	ii := sort.Search(len(t), func(i int) bool {
+		return t[i].End.Compare(addr) >= 0
+	})
+	if ii < len(t) && t[ii].Start.Compare(addr) <= 0 {
+		return t[ii].ISO
+	}
+	return ""
+}
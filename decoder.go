@@ -274,3 +274,175 @@ func (d *decoder) decodeMap(count int) (map[string]interface{}, error) {
 	}
 	return m, nil
 }
+
+// decodeKey works like decodeString, but returns the
+// bytes of the string in the data section, without copying
+// them. The returned slice must not be modified.
+func (d *decoder) decodeKey() ([]byte, error) {
+	t, size, err := d.decodeType()
+	if err != nil {
+		return nil, err
+	}
+	if t == typePointer {
+		dec := &decoder{d.data, size}
+		return dec.decodeKey()
+	}
+	if t != typeString {
+		return nil, fmt.Errorf("type %d is not string", t)
+	}
+	end := d.at + size
+	if end > len(d.data) {
+		return nil, fmt.Errorf("invalid data pointer %d - corrupted database?", end)
+	}
+	key := d.data[d.at:end]
+	d.at = end
+	return key, nil
+}
+
+// decodeSkipping works like decode, but skips the given
+// key in maps, at any depth.
+func (d *decoder) decodeSkipping(skipped string) (interface{}, error) {
+	start := d.at
+	t, size, err := d.decodeType()
+	if err != nil {
+		return nil, err
+	}
+	switch t {
+	case typePointer:
+		dec := &decoder{d.data, size}
+		return dec.decodeSkipping(skipped)
+	case typeArray:
+		values := make([]interface{}, size)
+		for ii := range values {
+			if values[ii], err = d.decodeSkipping(skipped); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for ii := 0; ii < size; ii++ {
+			key, err := d.decodeKey()
+			if err != nil {
+				return nil, err
+			}
+			if string(key) == skipped {
+				if err := d.skip(); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			value, err := d.decodeSkipping(skipped)
+			if err != nil {
+				return nil, err
+			}
+			m[string(key)] = value
+		}
+		return m, nil
+	}
+	d.at = start
+	return d.decode()
+}
+
+// skip advances the decoder past the current value
+// without decoding it.
+func (d *decoder) skip() error {
+	t, size, err := d.decodeType()
+	if err != nil {
+		return err
+	}
+	switch t {
+	case typePointer:
+		// decodeType already advanced past the pointer
+	case typeMap:
+		// keys + values
+		for ii := 0; ii < size*2; ii++ {
+			if err := d.skip(); err != nil {
+				return err
+			}
+		}
+	case typeArray:
+		for ii := 0; ii < size; ii++ {
+			if err := d.skip(); err != nil {
+				return err
+			}
+		}
+	case typeBoolean:
+		// value is stored in the size
+	default:
+		d.at += size
+	}
+	return nil
+}
+
+// followPointer moves the decoder to the value pointed
+// by the current one, if it's a pointer.
+func (d *decoder) followPointer() error {
+	cur, err := d.curData()
+	if err != nil {
+		return err
+	}
+	if len(cur) > 0 {
+		if t, _ := decodeType(cur); t == typePointer {
+			_, p, err := d.decodeType()
+			if err != nil {
+				return err
+			}
+			d.at = p
+		}
+	}
+	return nil
+}
+
+// keyEquals decodes a map key and compares it to key, without
+// allocating a string for the decoded one.
+func (d *decoder) keyEquals(key string) (bool, error) {
+	t, size, err := d.decodeType()
+	if err != nil {
+		return false, err
+	}
+	if t == typePointer {
+		dec := decoder{d.data, size}
+		return dec.keyEquals(key)
+	}
+	if t != typeString {
+		return false, fmt.Errorf("type %d is not string", t)
+	}
+	end := d.at + size
+	if end > len(d.data) {
+		return false, fmt.Errorf("invalid data pointer %d - corrupted database?", end)
+	}
+	eq := string(d.data[d.at:end]) == key
+	d.at = end
+	return eq, nil
+}
+
+// findMapKey expects the current value to be a map (or a pointer
+// to a map) and moves the decoder to the value for the given key,
+// returning true. If the map doesn't contain key, it returns false.
+// Values for other keys are skipped without decoding them.
+func (d *decoder) findMapKey(key string) (bool, error) {
+	if err := d.followPointer(); err != nil {
+		return false, err
+	}
+	t, size, err := d.decodeType()
+	if err != nil {
+		return false, err
+	}
+	if t != typeMap {
+		return false, fmt.Errorf("type %d is not map", t)
+	}
+	for ii := 0; ii < size; ii++ {
+		eq, err := d.keyEquals(key)
+		if err != nil {
+			return false, err
+		}
+		if eq {
+			return true, nil
+		}
+		if err := d.skip(); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
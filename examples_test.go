@@ -7,17 +7,17 @@ import (
 )
 
 func ExampleOpen() {
-	db, err := geoip.OpenGeoLite(geoip.GeoLiteKindCity)
+	db, err := geoip.Open("testdata/GeoIP2-City-Test.mmdb")
 	if err != nil {
 		panic(err)
 	}
-	res, err := db.Lookup("17.0.0.1")
+	res, err := db.Lookup("81.2.69.160")
 	if err != nil {
 		panic(err)
 	}
 	fmt.Println(res.Country.Name)
 	fmt.Println(res.City.Name)
 	// Output:
-	// United States
-	// Cupertino
+	// United Kingdom
+	// London
 }
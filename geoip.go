@@ -2,30 +2,52 @@ package geoip
 
 import (
 	"bytes"
-	"compress/gzip"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
+	"log"
 	"net"
+	"net/netip"
 	"os"
-	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// supportedFormatMajor is the latest MaxMind DB binary
+// format major version supported by this package.
+const supportedFormatMajor = 2
+
 var (
-	metaMarker            = []byte("\xab\xcd\xefMaxMind.com")
-	maxMetaSize           = 128 * 1024
-	errNoMetadata         = errors.New("can't find metadata - invalid mmdb file?")
-	errNoFormatMajor      = errors.New("binary_format_major_version not found in metadata")
-	errInvalidFormatMajor = errors.New("binary_format_major_version is not 2")
-	errNoIPVersion        = errors.New("missing IP version")
-	errInvalidDatabase    = errors.New("database seems to be corrupted")
-	errInvalidIP          = errors.New("invalid IP")
-	errNoMoreIP           = errors.New("finished looking at the IP addr without finding a match")
-	v4InV6Prefix          = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff}
+	metaMarker         = []byte("\xab\xcd\xefMaxMind.com")
+	maxMetaSize        = 128 * 1024
+	errNoMetadata      = errors.New("can't find metadata - invalid mmdb file?")
+	errNoFormatMajor   = errors.New("binary_format_major_version not found in metadata")
+	errNoIPVersion     = errors.New("missing IP version")
+	errInvalidDatabase = errors.New("database seems to be corrupted")
+	errInvalidIP       = errors.New("invalid IP")
+	errNoMoreIP        = errors.New("finished looking at the IP addr without finding a match")
+	errAddrNotFound    = errors.New("address not found")
+	v4InV6Prefix       = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff}
 )
 
+// notFoundError is returned when the database has no
+// record for an address.
+type notFoundError struct {
+	addr string
+}
+
+func (e *notFoundError) Error() string {
+	return fmt.Sprintf("address %s not found", e.addr)
+}
+
+func (e *notFoundError) Is(target error) bool {
+	return target == errAddrNotFound
+}
+
 // GeoIP represents an in-memory database which maps IP addresses,
 // either IPv4 or IPv6, to geographical information. You shouldn't
 // create multiple GeoIP instances. Instead, create only one and
@@ -33,6 +55,49 @@ var (
 // methods are safe to access from multiple goroutines concurrently.
 // Use New or Open to initialize a GeoIP.
 type GeoIP struct {
+	db       atomic.Pointer[database]
+	opts     options
+	cache    *lookupCache
+	releaser *releaser
+	metrics  atomic.Value // metricsValue
+	// Guards closers and releaser
+	mu      sync.Mutex
+	closers []func()
+	// source is where the database was loaded from,
+	// if known. See ReloadOnSignal.
+	source *source
+}
+
+// source is where a database was loaded from, used for
+// reloading it. Note that it must not reference the GeoIP,
+// otherwise the GeoIP would never become unreachable.
+type source struct {
+	// filename is set for databases opened with Open or OpenMmap
+	filename string
+	// mmap is set for databases opened with OpenMmap, which
+	// are mapped again when reloading them
+	mmap bool
+	// url is set for databases opened with OpenURL
+	url      string
+	resolved ResolvedOptions
+	urlOpts  *urlOptions
+}
+
+// ErrClosed is returned by lookups on a closed GeoIP.
+// See GeoIP.Close.
+var ErrClosed = errors.New("geoip: database is closed")
+
+// databaseGenerations is incremented for every new database,
+// so each one has its own generation. See lookupCache.
+var databaseGenerations atomic.Uint64
+
+// closedDatabase is used by closed GeoIP instances.
+var closedDatabase = &database{closed: true}
+
+// database holds the parsed data of a database file. Lookups
+// load the current database once, so they always see a
+// consistent one, even if it gets replaced concurrently.
+type database struct {
 	tree         []byte
 	data         []byte
 	ipVersion    int
@@ -44,22 +109,269 @@ type GeoIP struct {
 	recordShift  uint // = recordSize - (recordBytes * 8)
 	nodeCount    int
 	meta         map[string]interface{}
+	closed       bool
+	// generation identifies the database in the lookup
+	// cache, see lookupCache.
+	generation uint64
+	// Keeps the resources backing tree and data alive
+	// while db is in use, see setRelease.
+	releaser *releaser
+	// Guards the cached results below
+	mu           sync.Mutex
+	subdivisions map[string][]*Place
+	geonames     map[int]geonameEntry
+}
+
+// current returns the database currently used by g.
+func (g *GeoIP) current() *database {
+	return g.db.Load()
+}
+
+// ReplaceBytes parses the database in data and, if it's valid,
+// atomically replaces the database used by g with it. Lookups in
+// progress finish using the previous database, while the following
+// ones use the new one, so no lookup ever sees a mix of both. If data
+// is not a valid database, an error is returned and g keeps using its
+// current database. Note that data is copied, so callers might reuse
+// it afterwards.
+func (g *GeoIP) ReplaceBytes(data []byte) error {
+	db, err := newDatabase(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	return g.replace(db)
+}
+
+// Reload reads the database named filename and atomically replaces
+// the database used by g with it, like ReplaceBytes. Compressed
+// databases are supported, like in Open. If the file can't be read or
+// it's not a valid database, an error is returned and g keeps using
+// its current database. This allows updating the database of long
+// running processes without interrupting lookups. Databases opened
+// with OpenMmap map the new file, unless it's compressed, and the
+// previous mapping is released once it's garbage collected, since
+// lookups might still be using it.
+func (g *GeoIP) Reload(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return g.ReloadFrom(f)
+}
+
+// ReloadFrom works like Reload, but reads the database from r. For
+// databases opened with OpenMmap, r is only mapped if it's an *os.File.
+// Otherwise, it's read into memory and the original mapping is kept
+// until g is closed.
+func (g *GeoIP) ReloadFrom(r io.Reader) error {
+	if f, ok := r.(*os.File); ok && g.source != nil && g.source.mmap {
+		return g.reloadMmap(f)
+	}
+	return g.reloadData(r)
+}
+
+// reloadData implements ReloadFrom by reading r into memory.
+func (g *GeoIP) reloadData(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if data, err = decodeDatabase(data, 0); err != nil {
+		return err
+	}
+	db, err := newDatabaseBytes(data)
+	if err != nil {
+		return err
+	}
+	return g.replace(db)
+}
+
+// swap makes g use the database loaded by other. Lookups
+// in progress keep using the previous database. Since other
+// is not used anymore, its background goroutines are stopped.
+func (g *GeoIP) swap(other *GeoIP) error {
+	other.runClosers()
+	return g.replace(other.current())
+}
+
+// replace makes g use db, unless g has been closed,
+// in which case ErrClosed is returned.
+func (g *GeoIP) replace(db *database) error {
+	cur := g.current()
+	if cur.closed {
+		return ErrClosed
+	}
+	if cur.hasGeonameIndex() {
+		if err := db.buildGeonameIndex(); err != nil {
+			g.logf("geoip: error building geoname index: %v", err)
+		}
+	}
+	if !g.db.CompareAndSwap(cur, db) {
+		// Closed or replaced concurrently, retry
+		return g.replace(db)
+	}
+	g.resetLookupCache()
+	return nil
+}
+
+// Close releases the resources held by g, like the mapping of
+// databases opened with OpenMmap or the watcher started by
+// WatchFile, and makes any further lookups fail with ErrClosed.
+// Since lookups in progress might still be using the database,
+// Close must only be called once g is not used anymore, including
+// the Result and LazyRecord values obtained from it. Calling Close
+// more than once is a no-op.
+func (g *GeoIP) Close() error {
+	if g.db.Swap(closedDatabase).closed {
+		return nil
+	}
+	g.runClosers()
+	g.resetLookupCache()
+	g.mu.Lock()
+	r := g.releaser
+	g.mu.Unlock()
+	if r != nil {
+		return r.Release()
+	}
+	return nil
+}
+
+// onClose registers fn to be called when g is closed, used
+// for stopping the goroutines working on g in the background.
+func (g *GeoIP) onClose(fn func()) {
+	g.mu.Lock()
+	g.closers = append(g.closers, fn)
+	g.mu.Unlock()
+}
+
+// runClosers calls and unregisters the functions
+// registered with onClose.
+func (g *GeoIP) runClosers() {
+	g.mu.Lock()
+	closers := g.closers
+	g.closers = nil
+	g.mu.Unlock()
+	for _, fn := range closers {
+		fn()
+	}
 }
 
 // IPVersion returns the IP version the loaded database provides, either
 // 4 or 6.
 func (g *GeoIP) IPVersion() int {
-	return g.ipVersion
+	return g.current().ipVersion
 }
 
 // Updated returns the date when the loaded database was built.
 func (g *GeoIP) Updated() time.Time {
-	if t, ok := g.meta["build_epoch"].(uint64); ok {
+	return g.current().updated()
+}
+
+// Description returns the description of the loaded database (e.g.
+// "GeoLite2 City database") in the given language, falling back to
+// English. Languages are matched like in Name.LocalizedNameFallback.
+// If the database has no description, the empty string is returned.
+func (g *GeoIP) Description(lang string) string {
+	descriptions, _ := g.current().meta["description"].(map[string]interface{})
+	name := make(Name, len(descriptions))
+	for k, v := range descriptions {
+		if s, ok := v.(string); ok {
+			name[k] = s
+		}
+	}
+	return name.localizedNameOrEnglish(lang)
+}
+
+// Metadata contains the information stored in the metadata section
+// of a database. See GeoIP.Metadata.
+type Metadata struct {
+	// DatabaseType is the type of the database (e.g.
+	// GeoIP2-City or GeoLite2-ASN).
+	DatabaseType string
+	// Description contains the description of the database,
+	// keyed by language.
+	Description map[string]string
+	// Languages lists the languages which the database might
+	// include names for.
+	Languages []string
+	// BuildEpoch is the time when the database was built, as
+	// a Unix timestamp. See also BuildTime.
+	BuildEpoch uint64
+	// IPVersion is either 4 or 6.
+	IPVersion int
+	// NodeCount is the number of nodes in the search tree.
+	NodeCount int
+	// RecordSize is the size, in bits, of each record in
+	// the search tree.
+	RecordSize int
+	// BinaryFormatMajorVersion and BinaryFormatMinorVersion
+	// indicate the version of the database format.
+	BinaryFormatMajorVersion int
+	BinaryFormatMinorVersion int
+}
+
+// BuildTime returns m.BuildEpoch as a time.Time.
+func (m Metadata) BuildTime() time.Time {
+	return time.Unix(int64(m.BuildEpoch), 0)
+}
+
+// Metadata returns the metadata of the loaded database, which allows
+// verifying which edition and build is in use. Fields missing in the
+// database are left empty.
+func (g *GeoIP) Metadata() Metadata {
+	db := g.current()
+	m := Metadata{
+		IPVersion:  db.ipVersion,
+		NodeCount:  db.nodeCount,
+		RecordSize: db.recordSize,
+	}
+	m.DatabaseType, _ = db.meta["database_type"].(string)
+	m.BuildEpoch, _ = db.meta["build_epoch"].(uint64)
+	if v, ok := db.meta["binary_format_major_version"].(uint16); ok {
+		m.BinaryFormatMajorVersion = int(v)
+	}
+	if v, ok := db.meta["binary_format_minor_version"].(uint16); ok {
+		m.BinaryFormatMinorVersion = int(v)
+	}
+	if descriptions, ok := db.meta["description"].(map[string]interface{}); ok {
+		m.Description = make(map[string]string, len(descriptions))
+		for k, v := range descriptions {
+			if s, ok := v.(string); ok {
+				m.Description[k] = s
+			}
+		}
+	}
+	if languages, ok := db.meta["languages"].([]interface{}); ok {
+		for _, v := range languages {
+			if s, ok := v.(string); ok {
+				m.Languages = append(m.Languages, s)
+			}
+		}
+	}
+	return m
+}
+
+func (db *database) updated() time.Time {
+	if t, ok := db.meta["build_epoch"].(uint64); ok {
 		return time.Unix(int64(t), 0)
 	}
 	return time.Time{}
 }
 
+// MemoryUsage returns the number of bytes used by the search tree and
+// the data section of the loaded database, which account for almost
+// all the memory it uses. This is useful for sizing the memory limits
+// of processes which load several databases. Note that the metadata,
+// the lookup cache (see LookupCache) and the caches built on demand
+// (e.g. by BuildGeonameIndex) are not counted. For databases opened
+// with OpenMmap, this is the size of the mapped file, which lives in
+// the page cache rather than in the Go heap.
+func (g *GeoIP) MemoryUsage() int64 {
+	db := g.current()
+	return int64(len(db.tree) + len(db.data))
+}
+
 // Lookup returns the geographical information for the given
 // IP address. Note that addr can be an IP address or a CIDR.
 // Both IPv4 and IPv6 are supported by this method.
@@ -72,36 +384,473 @@ func (g *GeoIP) Lookup(addr string) (*Record, error) {
 }
 
 // LookupIP works like Lookup, but accepts a net.IP rather
-// than the address as a string.
-func (g *GeoIP) LookupIP(ip net.IP) (*Record, error) {
-	res, err := g.LookupIPValue(ip)
+// than the address as a string. If the database stores an array of
+// records for the network containing ip, they're merged into a single
+// Record using the first non-empty value for each field (see
+// MergeRecords).
+func (g *GeoIP) LookupIP(ip net.IP) (rec *Record, err error) {
+	if m := g.loadMetrics(); m != nil {
+		defer observeLookup(m, time.Now(), &err)
+	}
+	return g.lookupRecord(ip, func(db *database) (int, error) {
+		return db.lookupIPPointer(ip)
+	})
+}
+
+// LookupLang works like LookupIP, but the names in the returned
+// Record only include the translations for the given languages, plus
+// English as a fallback. Languages are matched like in
+// Name.LocalizedNameFallback (e.g. de-AT keeps the de translation).
+// This allows serving different sets of languages from the same GeoIP.
+func (g *GeoIP) LookupLang(ip net.IP, langs ...string) (*Record, error) {
+	rec, err := g.LookupIP(ip)
 	if err != nil {
 		return nil, err
 	}
-	return g.resultToRecord(res)
+	rec.onlyLanguages(langs)
+	return rec, nil
+}
+
+// LookupNetwork works like LookupIP, but also returns the network
+// containing ip which the record is associated with. Networks matched
+// in the IPv4 portion of the database, including the IPv4 subtree of
+// IPv6 databases, are returned as IPv4 networks, with a 4 byte IP and
+// a 32 bit mask, so the IP version of the match can be determined by
+// checking len(network.IP) or network.IP.To4() != nil. See also
+// LookupFull.
+func (g *GeoIP) LookupNetwork(ip net.IP) (*Record, *net.IPNet, error) {
+	res, err := g.lookupFull(ip)
+	if err != nil {
+		return nil, nil, err
+	}
+	return res.Record, res.Network, nil
+}
+
+// LookupResult contains all the information returned by LookupFull.
+type LookupResult struct {
+	// Record is the record associated with the IP address,
+	// or nil if it was not found.
+	Record *Record
+	// Network is the network containing the IP address which
+	// Record is associated with. When the address is not found,
+	// Network is the largest network containing it without any
+	// record. See LookupNetwork for how IPv4 networks are reported.
+	Network *net.IPNet
+	// PrefixLen is the prefix length of Network.
+	PrefixLen int
+	// Found is true iff the database has a record for the
+	// IP address.
+	Found bool
+	// BuildTime is the time when the database which returned
+	// the result was built (see Updated). Since the database
+	// might be replaced while running (e.g. by
+	// URLStaleWhileRevalidate), this is more accurate than calling
+	// Updated separately when recording where a result came from.
+	BuildTime time.Time
+}
+
+// LookupFull looks up the given IP and returns all the available
+// information about it in a LookupResult. Unlike LookupIP, an address
+// not found in the database is not an error, but it's reported via
+// LookupResult.Found.
+func (g *GeoIP) LookupFull(ip net.IP) (LookupResult, error) {
+	res, err := g.lookupFull(ip)
+	if err != nil && errors.Is(err, errAddrNotFound) {
+		err = nil
+	}
+	return res, err
+}
+
+func (g *GeoIP) lookupFull(ip net.IP) (LookupResult, error) {
+	db := g.current()
+	p, data, bits, err := db.lookupIPPrefix(ip)
+	if err != nil && !errors.Is(err, errAddrNotFound) {
+		return LookupResult{}, err
+	}
+	masked := net.IP(data).Mask(net.CIDRMask(bits, len(data)*8))
+	res := LookupResult{
+		Network:   db.walkNetwork(masked, bits),
+		BuildTime: db.updated(),
+	}
+	res.PrefixLen, _ = res.Network.Mask.Size()
+	if err != nil {
+		return res, err
+	}
+	rec, err := g.recordAt(db, p)
+	if err != nil {
+		return LookupResult{}, err
+	}
+	res.Record = rec
+	res.Found = true
+	return res, nil
+}
+
+// LookupIPWarnings works like LookupIP, but it also returns the
+// errors found while decoding the fields of the record, as *FieldError.
+// Fields which can't be decoded are left empty in the returned
+// Record. This allows detecting malformed databases, which would
+// otherwise return plausible but incomplete records.
+func (g *GeoIP) LookupIPWarnings(ip net.IP) (*Record, []error, error) {
+	res, err := g.LookupIPValue(ip)
+	if err != nil {
+		return nil, nil, err
+	}
+	return newRecordWarnings(res, &g.opts)
 }
 
 // LookupIPValue returns the raw value found in the database
 // for the given IP. Note that the type of value might vary
 // depending on the IP, but will usually be a map[string]interface{}.
 func (g *GeoIP) LookupIPValue(ip net.IP) (interface{}, error) {
+	db := g.current()
+	p, err := db.lookupIPPointer(ip)
+	if err != nil {
+		return nil, err
+	}
+	return db.lookupResult(p)
+}
+
+// LookupCountryCode returns the ISO 3166-1 2 letter country code for
+// the given IP, or the empty string if the record has no country. It's
+// substantially faster than LookupIP and barely allocates, since it only
+// decodes the country code from the record. Use it when you only need
+// the country (e.g. for geo-blocking).
+func (g *GeoIP) LookupCountryCode(ip net.IP) (string, error) {
+	db := g.current()
+	p, err := db.lookupIPPointer(ip)
+	if err != nil {
+		return "", err
+	}
+	return db.countryCodeAt(p)
+}
+
+// CountryHistogram looks up the given IPs and returns the number of
+// them associated with each country, keyed by its ISO 3166-1 2 letter
+// code (see LookupCountryCode). IPs which are not found in the database
+// or whose record has no country are counted under the empty string.
+// If any IP can't be looked up for other reasons (e.g. it's invalid),
+// an error is returned.
+func (g *GeoIP) CountryHistogram(ips []net.IP) (map[string]int, error) {
+	db := g.current()
+	histogram := make(map[string]int)
+	for _, ip := range ips {
+		p, err := db.lookupIPPointer(ip)
+		if err != nil {
+			if errors.Is(err, errAddrNotFound) {
+				histogram[""]++
+				continue
+			}
+			return nil, err
+		}
+		code, err := db.countryCodeAt(p)
+		if err != nil {
+			return nil, err
+		}
+		histogram[code]++
+	}
+	return histogram, nil
+}
+
+// countryCodeAt returns the country code for the
+// record at the given pointer.
+func (db *database) countryCodeAt(p int) (string, error) {
+	defer runtime.KeepAlive(db)
+	return db.stringAt(p-db.nodeCount-16, "country", "iso_code")
+}
+
+// stringAt decodes the string found by following the given
+// map keys from the record at offset off, returning the empty
+// string if any of the keys is missing. Records stored as arrays
+// are walked in order and the first non-empty value is returned,
+// matching how LookupIP merges them.
+func (db *database) stringAt(off int, keys ...string) (string, error) {
+	d := decoder{db.data, off}
+	if err := d.followPointer(); err != nil {
+		return "", err
+	}
+	if t, size, err := d.decodeType(); err == nil && t == typeArray {
+		for ii := 0; ii < size; ii++ {
+			s, err := db.stringAt(d.at, keys...)
+			if err != nil || s != "" {
+				return s, err
+			}
+			if err := d.skip(); err != nil {
+				return "", err
+			}
+		}
+		return "", nil
+	}
+	d.at = off
+	for _, key := range keys {
+		if found, err := d.findMapKey(key); !found || err != nil {
+			return "", err
+		}
+	}
+	return d.decodeString()
+}
+
+// LookupDomain returns the second level domain associated with the
+// given IP (see Record.Domain), or the empty string if the record has
+// no domain. Like LookupCountryCode, it only decodes the domain from
+// the record, so it's faster than LookupIP. The domain is only available
+// in GeoIP2-Domain and GeoIP2 Enterprise databases.
+func (g *GeoIP) LookupDomain(ip net.IP) (string, error) {
+	db := g.current()
+	p, err := db.lookupIPPointer(ip)
+	if err != nil {
+		return "", err
+	}
+	return db.domainAt(p)
+}
+
+// domainAt returns the domain for the record
+// at the given pointer.
+func (db *database) domainAt(p int) (string, error) {
+	defer runtime.KeepAlive(db)
+	off := p - db.nodeCount - 16
+	domain, err := db.stringAt(off, "domain")
+	if err != nil || domain != "" {
+		return domain, err
+	}
+	// GeoIP2 Enterprise stores it in the traits
+	return db.stringAt(off, "traits", "domain")
+}
+
+// LookupAddr works like LookupIP, but accepts a netip.Addr. This
+// avoids converting the address to a net.IP, so callers already
+// using net/netip don't incur in an extra allocation per lookup.
+func (g *GeoIP) LookupAddr(addr netip.Addr) (rec *Record, err error) {
+	if m := g.loadMetrics(); m != nil {
+		defer observeLookup(m, time.Now(), &err)
+	}
+	return g.lookupRecord(addr, func(db *database) (int, error) {
+		return db.lookupAddrPointer(addr)
+	})
+}
+
+// lookupRecord finds the pointer for addr in the current database
+// using find and returns its Record. If a timeout has been set with
+// LookupTimeout, the lookup runs in its own goroutine and an error
+// wrapping os.ErrDeadlineExceeded is returned if it doesn't finish
+// in time.
+func (g *GeoIP) lookupRecord(addr fmt.Stringer, find func(db *database) (int, error)) (*Record, error) {
+	db := g.current()
+	timeout := g.opts.lookupTimeout
+	if timeout <= 0 {
+		p, err := find(db)
+		if err != nil {
+			return nil, err
+		}
+		return g.recordAt(db, p)
+	}
+	type result struct {
+		rec *Record
+		err error
+	}
+	ch := make(chan result, 1)
+	// Keep the database resources until the lookup finishes, even if
+	// it times out and g is closed meanwhile.
+	db.releaser.acquire()
+	go func() {
+		defer db.releaser.done()
+		p, err := find(db)
+		if err != nil {
+			ch <- result{nil, err}
+			return
+		}
+		rec, err := g.recordAt(db, p)
+		ch <- result{rec, err}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case res := <-ch:
+		return res.rec, res.err
+	case <-timer.C:
+		return nil, fmt.Errorf("lookup of %s timed out after %s: %w", addr, timeout, os.ErrDeadlineExceeded)
+	}
+}
+
+// lookupIPPointer returns the pointer to the data section
+// for the given IP.
+func (db *database) lookupIPPointer(ip net.IP) (int, error) {
+	p, _, _, err := db.lookupIPPrefix(ip)
+	return p, err
+}
+
+// lookupIPPrefix works like lookupIPPointer, but also returns
+// the address used for traversing the tree, either 4 or 16 bytes
+// long, and the number of bits traversed until the data was found.
+func (db *database) lookupIPPrefix(ip net.IP) (int, []byte, int, error) {
 	if len(ip) == 0 {
-		return nil, errInvalidIP
+		return 0, nil, 0, errInvalidIP
 	}
 	start := 0
 	ipv4 := ip.To4()
 	if ipv4 != nil {
-		if g.ipVersion == 4 || g.ipv4Start > 0 {
+		if db.ipVersion == 4 || db.ipv4Start > 0 {
 			ip = ipv4
-			start = g.ipv4Start
+			start = db.ipv4Start
 		}
 	} else {
-		if g.ipVersion == 4 {
-			return nil, fmt.Errorf("can't look up IPv6 %s, database is IPv4", ip.String())
+		if db.ipVersion == 4 {
+			return 0, nil, 0, fmt.Errorf("can't look up IPv6 %s, database is IPv4", ip.String())
 		}
 	}
 	data := []byte(ip)
-	return g.lookupData(ip, data, start)
+	p, bits, err := db.lookupPrefix(data, start)
+	if err == errAddrNotFound {
+		err = &notFoundError{ip.String()}
+	}
+	return p, data, bits, err
+}
+
+// lookupAddrPointer works like lookupIPPointer, but
+// accepts a netip.Addr.
+func (db *database) lookupAddrPointer(addr netip.Addr) (int, error) {
+	if !addr.IsValid() {
+		return 0, errInvalidIP
+	}
+	var p int
+	var err error
+	if unmapped := addr.Unmap(); unmapped.Is4() && (db.ipVersion == 4 || db.ipv4Start > 0) {
+		data := unmapped.As4()
+		p, err = db.lookupPointer(data[:], db.ipv4Start)
+	} else {
+		if !unmapped.Is4() && db.ipVersion == 4 {
+			return 0, fmt.Errorf("can't look up IPv6 %s, database is IPv4", addr)
+		}
+		data := addr.As16()
+		p, err = db.lookupPointer(data[:], 0)
+	}
+	if err == errAddrNotFound {
+		err = &notFoundError{addr.String()}
+	}
+	return p, err
+}
+
+// releaser releases the resources held by a database outside of
+// the Go heap (e.g. its memory mapping). It's referenced by both the
+// GeoIP and its database, so it stays reachable while any of them is
+// in use, including lookups in progress and the Result values which
+// outlive their GeoIP.
+type releaser struct {
+	mu       sync.Mutex
+	release  func() error
+	users    int
+	pending  bool
+	retired  bool
+	errorLog *log.Logger
+}
+
+// Release calls the release function, unless it has already
+// been called. If there are lookups abandoned by LookupTimeout
+// still running, it's deferred until the last one finishes.
+func (r *releaser) Release() error {
+	r.mu.Lock()
+	if r.users > 0 {
+		r.pending = true
+		r.mu.Unlock()
+		return nil
+	}
+	release := r.release
+	r.release = nil
+	r.mu.Unlock()
+	runtime.SetFinalizer(r, nil)
+	if release != nil {
+		return release()
+	}
+	return nil
+}
+
+// acquire registers a lookup using the resources, which won't
+// be released until done is called. Both are no-ops on a nil
+// releaser, used by databases in the Go heap.
+func (r *releaser) acquire() {
+	if r != nil {
+		r.mu.Lock()
+		r.users++
+		r.mu.Unlock()
+	}
+}
+
+func (r *releaser) done() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.users--
+	pending := r.pending && r.users == 0
+	r.mu.Unlock()
+	if pending {
+		if err := r.Release(); err != nil {
+			r.logf("geoip: error releasing database: %v", err)
+		}
+	}
+}
+
+// retire marks r as belonging to a database replaced by a
+// reload, which is released by the finalizer once it's not used
+// anymore, without logging a warning. It's a no-op on a nil
+// releaser.
+func (r *releaser) retire() {
+	if r != nil {
+		r.mu.Lock()
+		r.retired = true
+		r.mu.Unlock()
+	}
+}
+
+func (r *releaser) finalize() {
+	r.mu.Lock()
+	release, retired := r.release, r.retired
+	r.mu.Unlock()
+	if release == nil {
+		return
+	}
+	if !retired {
+		r.logf("geoip: database garbage collected without being closed, releasing its resources")
+	}
+	if err := r.Release(); err != nil {
+		r.logf("geoip: error releasing database: %v", err)
+	}
+}
+
+func (r *releaser) logf(format string, args ...interface{}) {
+	if r.errorLog != nil {
+		r.errorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// setRelease sets the function which releases the resources held
+// by db, which must be the database used by g, outside of the Go
+// heap. It also sets a finalizer which calls it if both g and db are
+// garbage collected without being released, logging a warning. This
+// is only a safety net against leaks, since the finalizer might run
+// much later than the database stops being used or even not run at
+// all.
+func (g *GeoIP) setRelease(db *database, release func() error) {
+	r := g.newReleaser(release)
+	db.releaser = r
+	g.releaser = r
+}
+
+// newReleaser returns a releaser for release with
+// its finalizer set. See setRelease.
+func (g *GeoIP) newReleaser(release func() error) *releaser {
+	r := &releaser{release: release, errorLog: g.opts.errorLog}
+	runtime.SetFinalizer(r, (*releaser).finalize)
+	return r
+}
+
+func (g *GeoIP) logf(format string, args ...interface{}) {
+	if g.opts.errorLog != nil {
+		g.opts.errorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
 }
 
 func (g *GeoIP) parseIP(addr string) (net.IP, error) {
@@ -116,21 +865,35 @@ func (g *GeoIP) parseIP(addr string) (net.IP, error) {
 	return ip, nil
 }
 
-func (g *GeoIP) lookupData(ip net.IP, data []byte, node int) (interface{}, error) {
+// lookupPointer walks the tree starting at node following the
+// bits in data. If a record is found, its pointer is returned.
+// If data is exhausted before finding a record, the last node
+// is returned with errNoMoreIP.
+func (db *database) lookupPointer(data []byte, node int) (int, error) {
+	p, _, err := db.lookupPrefix(data, node)
+	return p, err
+}
+
+// lookupPrefix works like lookupPointer, but also returns the
+// number of bits of data traversed until the result was found.
+func (db *database) lookupPrefix(data []byte, node int) (int, int, error) {
+	if db.closed {
+		return 0, 0, ErrClosed
+	}
 	ii := 0
 	bit := 0
 	b := data[0]
 	for {
-		next := g.decodeNode(node, b&0x80 != 0)
-		if next == g.nodeCount {
+		next := db.decodeNode(node, b&0x80 != 0)
+		if next == db.nodeCount {
 			// Not found
-			return nil, fmt.Errorf("address %s not found", ip)
+			return 0, ii*8 + bit + 1, errAddrNotFound
 		}
-		if next > g.nodeCount {
+		if next > db.nodeCount {
 			// Found data
-			return g.lookupResult(next)
+			return next, ii*8 + bit + 1, nil
 		}
-		// next < g.nodeCount, keep iterating
+		// next < db.nodeCount, keep iterating
 		node = next
 		bit++
 		b = b << 1
@@ -143,80 +906,243 @@ func (g *GeoIP) lookupData(ip net.IP, data []byte, node int) (interface{}, error
 			b = data[ii]
 		}
 	}
-	return node, errNoMoreIP
+	return node, len(data) * 8, errNoMoreIP
 }
 
-func (g *GeoIP) decodeNode(node int, right bool) int {
-	data := g.tree[g.nodeSize*node:]
-	if g.nodeSizeEven {
+func (db *database) decodeNode(node int, right bool) int {
+	data := db.tree[db.nodeSize*node:]
+	if db.nodeSizeEven {
 		// Format for e.g. 6 bytes
 		// | <------------- node --------------->|
 		// | 23 .. 0          |          23 .. 0 |
 		if right {
-			data = data[g.recordBytes:]
+			data = data[db.recordBytes:]
 		}
-		return int(decodeUint64(data, g.recordBytes))
+		return int(decodeUint64(data, db.recordBytes))
 	}
 	// Format for e.g. 7 bytes
 	// | <------------- node --------------->|
 	// | 23 .. 0 | 27..24 | 27..24 | 23 .. 0 |
 	if right {
 		// Decode value except the most significant nibble
-		val := decodeUint64(data[g.recordBytes+1:], g.recordBytes)
+		val := decodeUint64(data[db.recordBytes+1:], db.recordBytes)
 		// MSN is the second nibble in the byte just before
 		// the decoded ones.
-		val = val | uint64(data[g.recordBytes]&0x0F)<<g.recordShift
+		val = val | uint64(data[db.recordBytes]&0x0F)<<db.recordShift
 		return int(val)
 	}
 	// Decode value except the most significant nibble
-	val := decodeUint64(data, g.recordBytes)
+	val := decodeUint64(data, db.recordBytes)
 	// Add nibble just after the decoded data as the MSB
-	val = val | uint64(data[g.recordBytes]>>4)<<g.recordShift
+	val = val | uint64(data[db.recordBytes]>>4)<<db.recordShift
 	return int(val)
 }
 
-func (g *GeoIP) lookupResult(p int) (interface{}, error) {
-	offset := p - g.nodeCount - 16
-	dec := &decoder{g.data, offset}
+func (db *database) lookupResult(p int) (interface{}, error) {
+	defer runtime.KeepAlive(db)
+	offset := p - db.nodeCount - 16
+	dec := &decoder{db.data, offset}
 	return dec.decode()
 }
 
+// recordValue works like lookupResult, but only decodes the
+// parts of the value used by records decoded with opts. See
+// decoder.decodeRecord.
+func (db *database) recordValue(p int, opts *options) (interface{}, error) {
+	defer runtime.KeepAlive(db)
+	dec := &decoder{db.data, p - db.nodeCount - 16}
+	return dec.decodeRecord(opts)
+}
+
 func (g *GeoIP) resultToRecord(val interface{}) (*Record, error) {
-	return newRecord(val)
+	return newRecord(val, &g.opts)
 }
 
 // New parses the given database as an io.ReadSeeker and returns a new
 // GeoIP. If the database does not have the correct format, an error
-// will be returned. See also Open.
-func New(r io.ReadSeeker) (*GeoIP, error) {
-	return newGeoIP(r)
+// will be returned. The opts arguments might be used to tune how records
+// are decoded, see Opt for more information. See also Open.
+func New(r io.ReadSeeker, opts ...Opt) (*GeoIP, error) {
+	db, err := newDatabase(r)
+	if err != nil {
+		return nil, err
+	}
+	return newGeoIP(db, opts), nil
+}
+
+// NewFromBytes returns a new GeoIP which uses the database in data
+// directly, without copying it. This avoids duplicating databases
+// embedded in the binary (e.g. with go:embed) or already held in
+// memory, so data must not be modified afterwards. Compressed
+// databases are also accepted, but since they must be decompressed
+// first, they don't benefit from avoiding the copy. The opts arguments
+// work like in New.
+func NewFromBytes(data []byte, opts ...Opt) (*GeoIP, error) {
+	data, err := decodeDatabase(data, 0)
+	if err != nil {
+		return nil, err
+	}
+	db, err := newDatabaseBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	return newGeoIP(db, opts), nil
+}
+
+// newGeoIP returns a GeoIP using db with the given options.
+func newGeoIP(db *database, opts []Opt) *GeoIP {
+	g := new(GeoIP)
+	g.db.Store(db)
+	for _, opt := range opts {
+		opt(&g.opts)
+	}
+	if g.opts.cacheSize > 0 {
+		g.cache = newLookupCache(g.opts.cacheSize, db.generation)
+	}
+	return g
+}
+
+// NewSized reads a database of the given size from r and returns
+// a new GeoIP. Unlike New, r doesn't need to support seeking and
+// might be gzip compressed, in which case size should be the
+// compressed size. Knowing the size in advance allows allocating
+// the buffer for the database only once, rather than growing it
+// while reading, and reporting the progress of the read with
+// ReadProgress. If size is not known, pass a value <= 0. The opts
+// arguments work like in New.
+func NewSized(r io.Reader, size int64, opts ...Opt) (*GeoIP, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	var buf *bytes.Buffer
+	if size > 0 {
+		buf = bytes.NewBuffer(make([]byte, 0, size+bytes.MinRead))
+	} else {
+		buf = new(bytes.Buffer)
+	}
+	if o.progress != nil {
+		r = &progressReader{r: r, total: size, fn: o.progress}
+	}
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	data, err := decodeDatabase(buf.Bytes(), 0)
+	if err != nil {
+		return nil, err
+	}
+	db, err := newDatabaseBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	return newGeoIP(db, opts), nil
+}
+
+// progressReader wraps an io.Reader, reporting the
+// number of bytes read to fn. See ReadProgress.
+type progressReader struct {
+	r     io.Reader
+	read  int64
+	total int64
+	fn    func(read, total int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.read += int64(n)
+		p.fn(p.read, p.total)
+	}
+	return n, err
 }
 
 // Open initializes a GeoIP from the database named filename. Note that
-// if the database file has the .gz extension (e.g. GeoLite2-City.mmdb.gz),
-// it will be automatically decompressed in memory before loading it.
-func Open(filename string) (*GeoIP, error) {
+// if the database file is gzip compressed (e.g. GeoLite2-City.mmdb.gz),
+// it will be automatically decompressed in memory before loading it. Gzip
+// compressed tar archives, like the ones served by MaxMind, are also
+// supported and the first .mmdb file inside them is loaded.
+// The opts arguments are passed unmodified to New.
+func Open(filename string, opts ...Opt) (*GeoIP, error) {
 	f, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
-	if filepath.Ext(filename) == ".gz" {
-		r, err := gzip.NewReader(f)
+	g, err := OpenFile(f, opts...)
+	if err != nil {
+		return nil, err
+	}
+	g.source = &source{filename: filename}
+	if err := g.watch(filename); err != nil {
+		g.Close()
+		return nil, err
+	}
+	return g, nil
+}
+
+// OpenFS works like Open, but reads the database named name from
+// fsys. This allows opening databases bundled with embed.FS, stored
+// in zip archives (see archive/zip.Reader) or provided by test
+// fixtures (see testing/fstest) without touching the OS filesystem.
+// Like Open, compressed databases are supported.
+func OpenFS(fsys fs.FS, name string, opts ...Opt) (*GeoIP, error) {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	return NewFromBytes(data, opts...)
+}
+
+// OpenWithFallback calls primary to open a database (e.g. using
+// OpenURL) and, if it fails, returns fallback instead, logging the
+// error (see ErrorLog). This allows programs to degrade gracefully
+// rather than failing to start when no download nor cached database
+// is available. Note that the fallback is usually a small database
+// (e.g. a country level one loaded with New from an embedded file),
+// so its records might be less accurate. If fallback is nil, the error
+// from primary is returned.
+func OpenWithFallback(primary func() (*GeoIP, error), fallback *GeoIP) (*GeoIP, error) {
+	g, err := primary()
+	if err == nil {
+		return g, nil
+	}
+	if fallback == nil {
+		return nil, err
+	}
+	fallback.logf("geoip: error opening database, using fallback: %v", err)
+	return fallback, nil
+}
+
+// OpenFile works like Open, but reads the database from an already
+// opened file. This is useful in sandboxed environments where the
+// process can't open files by itself. The database is read from the
+// start of the file, regardless of its current offset. Note that
+// the caller retains the ownership of f and it's responsible for
+// closing it.
+func OpenFile(f *os.File, opts ...Opt) (*GeoIP, error) {
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		return nil, err
+	}
+	var magic [2]byte
+	n, err := io.ReadFull(f, magic[:])
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	if n == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		rest, err := ioutil.ReadAll(f)
 		if err != nil {
 			return nil, err
 		}
-		defer r.Close()
-		data, err := ioutil.ReadAll(r)
+		data, err := decodeDatabase(append(magic[:], rest...), 0)
 		if err != nil {
 			return nil, err
 		}
-		return New(bytes.NewReader(data))
+		return New(bytes.NewReader(data), opts...)
 	}
-	return New(f)
+	return New(f, opts...)
 }
 
-func newGeoIP(r io.ReadSeeker) (g *GeoIP, err error) {
+func newDatabase(r io.ReadSeeker) (db *database, err error) {
 	defer func() {
 		if rec := recover(); rec != nil {
 			if e, ok := rec.(error); ok {
@@ -248,6 +1174,117 @@ func newGeoIP(r io.ReadSeeker) (g *GeoIP, err error) {
 	if err != nil {
 		return nil, err
 	}
+	db, err = databaseFromMetadata(metaData)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(0, os.SEEK_SET); err != nil {
+		return nil, err
+	}
+	// Read tree
+	treeSize := db.nodeSize * db.nodeCount
+	db.tree = make([]byte, treeSize)
+	if _, err := io.ReadFull(r, db.tree); err != nil {
+		return nil, err
+	}
+	// Discard 16 null bytes after tree
+	if _, err := io.CopyN(ioutil.Discard, r, 16); err != nil {
+		return nil, err
+	}
+	// Read the data
+	db.data = make([]byte, int(total)-(treeSize+16+len(metaData)+len(metaMarker)))
+	if _, err := io.ReadFull(r, db.data); err != nil {
+		return nil, err
+	}
+	db.findIPv4Start()
+	return db, nil
+}
+
+// newDatabaseBytes works like newDatabase, but uses the tree
+// and the data section in buf directly, without copying them.
+// Callers must not modify buf afterwards.
+func newDatabaseBytes(buf []byte) (db *database, err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			if e, ok := rec.(error); ok {
+				err = e
+			} else {
+				err = errInvalidDatabase
+			}
+		}
+	}()
+	metaData, err := findMetadata(buf)
+	if err != nil {
+		return nil, err
+	}
+	db, err = databaseFromMetadata(metaData)
+	if err != nil {
+		return nil, err
+	}
+	treeSize := db.nodeSize * db.nodeCount
+	dataEnd := len(buf) - len(metaData) - len(metaMarker)
+	if treeSize+16 > dataEnd {
+		return nil, errInvalidDatabase
+	}
+	db.tree = buf[:treeSize:treeSize]
+	db.data = buf[treeSize+16 : dataEnd : dataEnd]
+	db.findIPv4Start()
+	return db, nil
+}
+
+// readMetadata decodes only the metadata section of the database
+// in r, which might be gzip compressed, returning a database without
+// its tree nor its data. It allows inspecting a database without
+// loading it.
+func readMetadata(r io.ReadSeeker) (db *database, err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			if e, ok := rec.(error); ok {
+				err = e
+			} else {
+				err = errInvalidDatabase
+			}
+		}
+	}()
+	var magic [2]byte
+	n, err := io.ReadFull(r, magic[:])
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	var end []byte
+	if n == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		if _, err := r.Seek(0, os.SEEK_SET); err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		if end, err = decodeDatabase(data, 0); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := r.Seek(-int64(maxMetaSize), os.SEEK_END); err != nil {
+			// File might be smaller than maxMetaSize, seek to start
+			if _, err := r.Seek(0, os.SEEK_SET); err != nil {
+				return nil, err
+			}
+		}
+		if end, err = ioutil.ReadAll(r); err != nil {
+			return nil, err
+		}
+	}
+	metaData, err := findMetadata(end)
+	if err != nil {
+		return nil, err
+	}
+	return databaseFromMetadata(metaData)
+}
+
+// databaseFromMetadata decodes the given metadata section and
+// returns a database with its fields set, but without its tree
+// nor its data.
+func databaseFromMetadata(metaData []byte) (*database, error) {
 	dec := &decoder{data: metaData}
 	metaVal, err := dec.decode()
 	if err != nil {
@@ -261,8 +1298,8 @@ func newGeoIP(r io.ReadSeeker) (g *GeoIP, err error) {
 	if !ok {
 		return nil, errNoFormatMajor
 	}
-	if major != 2 {
-		return nil, errInvalidFormatMajor
+	if major != supportedFormatMajor {
+		return nil, fmt.Errorf("unsupported mmdb binary format version %d; this library supports up to %d", major, supportedFormatMajor)
 	}
 	ipVersion, ok := meta["ip_version"].(uint16)
 	if !ok {
@@ -271,31 +1308,12 @@ func newGeoIP(r io.ReadSeeker) (g *GeoIP, err error) {
 	if ipVersion != 4 && ipVersion != 6 {
 		return nil, fmt.Errorf("invalid IP version %d", ipVersion)
 	}
-	if _, err := r.Seek(0, os.SEEK_SET); err != nil {
-		return nil, err
-	}
 	recordSize := int(meta["record_size"].(uint16))
 	nodeCount := int(meta["node_count"].(uint32))
-	// Read tree
 	nodeSize := recordSize * 2 / 8
-	treeSize := nodeSize * nodeCount
-	tree := make([]byte, treeSize)
-	if _, err := io.ReadFull(r, tree); err != nil {
-		return nil, err
-	}
-	// Discard 16 null bytes after tree
-	if _, err := io.CopyN(ioutil.Discard, r, 16); err != nil {
-		return nil, err
-	}
-	// Read the data
-	data := make([]byte, int(total)-(treeSize+16+len(metaData)+len(metaMarker)))
-	if _, err := io.ReadFull(r, data); err != nil {
-		return nil, err
-	}
 	recordBytes := recordSize / 8
-	geo := &GeoIP{
-		tree:         tree,
-		data:         data,
+	return &database{
+		generation:   databaseGenerations.Add(1),
 		ipVersion:    int(ipVersion),
 		recordSize:   recordSize,
 		recordBytes:  recordBytes,
@@ -304,16 +1322,17 @@ func newGeoIP(r io.ReadSeeker) (g *GeoIP, err error) {
 		recordShift:  uint(recordSize - recordBytes*8),
 		nodeCount:    nodeCount,
 		meta:         meta,
-	}
-	if ipVersion == 6 {
-		s, err := geo.lookupData(nil, v4InV6Prefix, 0)
-		if err == errNoMoreIP {
-			if i, ok := s.(int); ok {
-				geo.ipv4Start = i
-			}
+	}, nil
+}
+
+// findIPv4Start sets the start of the IPv4
+// subtree in IPv6 databases.
+func (db *database) findIPv4Start() {
+	if db.ipVersion == 6 {
+		if node, err := db.lookupPointer(v4InV6Prefix, 0); err == errNoMoreIP {
+			db.ipv4Start = node
 		}
 	}
-	return geo, nil
 }
 
 func findMetadata(data []byte) ([]byte, error) {
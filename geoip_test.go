@@ -2,19 +2,32 @@ package geoip
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
+	"log"
 	"math"
 	"math/big"
 	"net"
+	"net/http/httptest"
+	"net/netip"
 	"os"
 	"path/filepath"
 	"reflect"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"testing/fstest"
+	"testing/iotest"
+	"time"
 )
 
 func readFile(t testing.TB, filename string) []byte {
@@ -355,3 +368,2742 @@ func makeBigInt(s string) *big.Int {
 	}
 	return i
 }
+
+func TestMergeRecords(t *testing.T) {
+	city := &Record{
+		Country:   &Place{Code: "US"},
+		City:      &Place{Code: "", Name: Name{"en": "Cupertino"}},
+		Latitude:  37.3,
+		Longitude: -122.0,
+	}
+	other := &Record{
+		Country:  &Place{Code: "CA"},
+		Latitude: 1,
+		TimeZone: "America/Los_Angeles",
+	}
+	merged := MergeRecords(func(field string) int {
+		if field == "Country" {
+			return 1
+		}
+		return 0
+	}, city, nil, other)
+	if merged.CountryCode() != "US" {
+		t.Errorf("expecting country US when preferred record is nil, got %q", merged.CountryCode())
+	}
+	merged = MergeRecords(func(field string) int {
+		if field == "Country" {
+			return 2
+		}
+		return 0
+	}, city, nil, other)
+	if merged.CountryCode() != "CA" {
+		t.Errorf("expecting country CA, got %q", merged.CountryCode())
+	}
+	if merged.Latitude != 37.3 || merged.Longitude != -122.0 {
+		t.Errorf("expecting coordinates from first record, got %v, %v", merged.Latitude, merged.Longitude)
+	}
+	if merged.TimeZone != "America/Los_Angeles" {
+		t.Errorf("expecting time zone from last record, got %q", merged.TimeZone)
+	}
+	if merged.City != city.City {
+		t.Error("expecting city from first record")
+	}
+	// Coordinates are never mixed from different records
+	partial := &Record{Latitude: 10}
+	located := &Record{Latitude: 37.3, Longitude: -122.0, coords: true}
+	merged, sources := mergeRecords(nil, []*Record{partial, located})
+	if merged.Latitude != 37.3 || merged.Longitude != -122.0 || !merged.HasCoordinates() {
+		t.Errorf("expecting coordinates from the located record, got %v, %v", merged.Latitude, merged.Longitude)
+	}
+	typ := reflect.TypeOf(merged).Elem()
+	for ii, v := range sources {
+		if name := typ.Field(ii).Name; (name == "Latitude" || name == "Longitude") && v != 1 {
+			t.Errorf("expecting %s from record 1, got %d", name, v)
+		}
+	}
+}
+
+func TestLookupAddr(t *testing.T) {
+	geo := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if geo == nil {
+		return
+	}
+	for _, v := range []string{"81.2.69.160", "2.125.160.216", "::ffff:81.2.69.160", "2001:218::1", "10.0.0.1"} {
+		expected, expectedErr := geo.Lookup(v)
+		rec, err := geo.LookupAddr(netip.MustParseAddr(v))
+		if (err != nil) != (expectedErr != nil) {
+			t.Errorf("expecting error %v for %s, got %v", expectedErr, v, err)
+			continue
+		}
+		if !reflect.DeepEqual(rec, expected) {
+			t.Errorf("expecting %+v for %s, got %+v", expected, v, rec)
+		}
+	}
+}
+
+func TestDecodeFields(t *testing.T) {
+	data := readFile(t, "GeoIP2-City-Test.mmdb")
+	geo, err := New(bytes.NewReader(data), DecodeFields(FieldCountry|FieldLocation))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := geo.Lookup("81.2.69.160")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.CountryCode() != "GB" {
+		t.Errorf("expecting country GB, got %q", rec.CountryCode())
+	}
+	if rec.Latitude == 0 || rec.TimeZone == "" {
+		t.Error("expecting location to be decoded")
+	}
+	if rec.City != nil || rec.Continent != nil || len(rec.Subdivisions) > 0 {
+		t.Errorf("expecting only country and location, got %+v", rec)
+	}
+	// ASN, ISP and organization are selected with FieldASN
+	val := map[string]interface{}{
+		"autonomous_system_number": uint32(1221),
+		"isp":                      "Telstra Internet",
+		"traits": map[string]interface{}{
+			"autonomous_system_organization": "Telstra Pty Ltd",
+			"organization":                   "Telstra",
+			"user_type":                      "business",
+		},
+	}
+	rec, err = newRecord(val, &options{fields: FieldASN})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.ASN != 1221 || rec.ISP != "Telstra Internet" || rec.ASOrganization != "Telstra Pty Ltd" || rec.Organization != "Telstra" {
+		t.Errorf("expecting ASN fields to be decoded, got %+v", rec)
+	}
+	if rec.UserType != "" {
+		t.Errorf("expecting traits not to be decoded with FieldASN, got user type %q", rec.UserType)
+	}
+	rec, err = newRecord(val, &options{fields: FieldTraits})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.ASN != 0 || rec.ISP != "" || rec.ASOrganization != "" || rec.Organization != "" || rec.UserType != "business" {
+		t.Errorf("expecting only traits with FieldTraits, got %+v", rec)
+	}
+	for _, k := range []string{"autonomous_system_number", "autonomous_system_organization", "isp", "organization"} {
+		if f := recordKeys[k]; f != FieldASN {
+			t.Errorf("expecting %s to be decoded with FieldASN, got %v", k, f)
+		}
+	}
+}
+
+func TestMock(t *testing.T) {
+	var _ Lookuper = (*GeoIP)(nil)
+	rec := &Record{Country: &Place{Code: "US"}}
+	m := NewMock(map[string]*Record{"17.0.0.1": rec, "2001:DB8::1": rec})
+	for _, v := range []string{"17.0.0.1", "::ffff:17.0.0.1", "2001:db8::1"} {
+		res, err := m.Lookup(v)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if res != rec {
+			t.Errorf("expecting canned record for %s, got %+v", v, res)
+		}
+	}
+	// Unknown addresses fail like in a *GeoIP
+	if _, err := m.Lookup("17.0.0.2"); !errors.Is(err, errAddrNotFound) {
+		t.Errorf("expecting a not found error for unknown address, got %v", err)
+	}
+	if geo := testNewGeoIP(t, "GeoIP2-City-Test.mmdb"); geo != nil {
+		_, want := geo.Lookup("127.0.0.1")
+		if _, err := m.Lookup("127.0.0.1"); err == nil || err.Error() != want.Error() {
+			t.Errorf("expecting error %v, got %v", want, err)
+		}
+	}
+	network := &Record{Country: &Place{Code: "GB"}}
+	subnet := &Record{Country: &Place{Code: "FR"}}
+	m = NewMock(map[string]*Record{"10.0.0.0/8": network, "10.1.0.0/16": subnet, "2001:db8::/32": network})
+	cases := map[string]*Record{
+		"10.2.3.4":        network,
+		"10.1.2.3":        subnet,
+		"::ffff:10.1.2.3": subnet,
+		"2001:db8:1::1":   network,
+	}
+	for k, v := range cases {
+		res, err := m.Lookup(k)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if res != v {
+			t.Errorf("expecting country %s for %s, got %s", v.CountryCode(), k, res.CountryCode())
+		}
+	}
+	if _, err := m.Lookup("11.0.0.1"); err == nil {
+		t.Error("expecting an error for an address outside of the networks")
+	}
+}
+
+func TestCoverageByCountry(t *testing.T) {
+	geo := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if geo == nil {
+		return
+	}
+	coverage, err := geo.CoverageByCountry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(coverage) == 0 {
+		t.Fatal("expecting some countries")
+	}
+	for _, code := range []string{"GB", "JP", "KR"} {
+		if coverage[code] == 0 {
+			t.Errorf("expecting networks for country %s", code)
+		}
+	}
+}
+
+func TestWalkIPv4(t *testing.T) {
+	geo := testNewGeoIP(t, "MaxMind-DB-test-mixed-24.mmdb")
+	if geo == nil {
+		return
+	}
+	var networks []string
+	err := geo.current().walk(func(network *net.IPNet, ptr int) error {
+		networks = append(networks, network.String())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	has := make(map[string]bool)
+	for _, v := range networks {
+		if has[v] {
+			t.Errorf("network %s reported twice", v)
+		}
+		has[v] = true
+	}
+	for _, v := range []string{"1.1.1.1/32", "1.1.1.32/32", "::2:0:0/122"} {
+		if !has[v] {
+			t.Errorf("missing network %s in %v", v, networks)
+		}
+	}
+}
+
+func TestTraitBool(t *testing.T) {
+	m := map[string]interface{}{
+		"traits":                map[string]interface{}{"is_anonymous_proxy": true, "is_anycast": true, "user_type": "business", "static_ip_score": 1.5, "network": "1.2.3.0/24"},
+		"is_satellite_provider": true,
+	}
+	rec, err := newRecord(m, &options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rec.IsAnonymousProxy {
+		t.Error("expecting IsAnonymousProxy from traits")
+	}
+	if !rec.IsSatelliteProvider {
+		t.Error("expecting IsSatelliteProvider from top level")
+	}
+	if !rec.IsAnycast {
+		t.Error("expecting IsAnycast from traits")
+	}
+	if rec.UserType != "business" {
+		t.Errorf("expecting user type business, got %q", rec.UserType)
+	}
+	if rec.StaticIPScore != 1.5 {
+		t.Errorf("expecting static IP score 1.5, got %v", rec.StaticIPScore)
+	}
+	if rec.Network != "1.2.3.0/24" {
+		t.Errorf("expecting network 1.2.3.0/24, got %q", rec.Network)
+	}
+}
+
+func TestLookupDecoder(t *testing.T) {
+	geo := testNewGeoIP(t, "MaxMind-DB-test-decoder.mmdb")
+	if geo == nil {
+		return
+	}
+	res, err := geo.LookupDecoder(net.ParseIP("1.1.1.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		Boolean bool
+		Float   float32
+		Int32   int    `maxminddb:"int32"`
+		Uint16  uint64 `maxminddb:"uint16"`
+		Uint128 *big.Int
+		Bytes   []byte
+		String  string   `maxminddb:"utf8_string"`
+		Array   []uint32 `maxminddb:"array"`
+		Map     struct {
+			MapX struct {
+				ArrayX []int           `maxminddb:"arrayX"`
+				Other  map[string]bool `maxminddb:"-"`
+			} `maxminddb:"mapX"`
+		}
+		Raw interface{} `maxminddb:"double"`
+	}
+	if err := res.Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !out.Boolean || out.Int32 != -268435456 || out.Uint16 != 100 || out.String != "unicode! ☯ - ♫" {
+		t.Errorf("unexpected decoded value %+v", out)
+	}
+	if !reflect.DeepEqual(out.Array, []uint32{1, 2, 3}) || !reflect.DeepEqual(out.Map.MapX.ArrayX, []int{7, 8, 9}) {
+		t.Errorf("unexpected decoded arrays %+v", out)
+	}
+	if out.Raw != float64(42.123456) {
+		t.Errorf("expecting raw double, got %v", out.Raw)
+	}
+	if out.Uint128 == nil || out.Uint128.Cmp(expectedValue(net.ParseIP("1.1.1.1"), "MaxMind-DB-test-decoder.mmdb").(map[string]interface{})["uint128"].(*big.Int)) != 0 {
+		t.Errorf("unexpected uint128 %v", out.Uint128)
+	}
+	var bad struct {
+		Boolean string
+	}
+	if err := res.Decode(&bad); err == nil {
+		t.Error("expecting an error decoding bool into string")
+	}
+}
+
+func TestLocalizedNames(t *testing.T) {
+	geo := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if geo == nil {
+		return
+	}
+	rec, err := geo.Lookup("2.125.160.216")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := rec.LocalizedNames("de")
+	expected := map[string]string{
+		"continent":   "Europa",
+		"country":     "Vereinigtes Königreich",
+		"subdivision": "England",
+		"city":        "Boxford",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expecting names %v, got %v", expected, names)
+	}
+}
+
+type testMetrics struct {
+	lookups, notFound, errors int
+	latency                   time.Duration
+}
+
+func (m *testMetrics) IncLookup()                     { m.lookups++ }
+func (m *testMetrics) IncNotFound()                   { m.notFound++ }
+func (m *testMetrics) IncError()                      { m.errors++ }
+func (m *testMetrics) ObserveLatency(d time.Duration) { m.latency += d }
+
+func TestMetrics(t *testing.T) {
+	geo := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if geo == nil {
+		return
+	}
+	m := new(testMetrics)
+	geo.SetMetrics(m)
+	geo.Lookup("81.2.69.160")
+	geo.Lookup("10.0.0.1")
+	geo.LookupIP(nil)
+	geo.LookupAddr(netip.MustParseAddr("81.2.69.160"))
+	if m.lookups != 4 || m.notFound != 1 || m.errors != 1 {
+		t.Errorf("unexpected metrics %+v", m)
+	}
+	geo.SetMetrics(nil)
+	geo.Lookup("81.2.69.160")
+	if m.lookups != 4 {
+		t.Errorf("expecting no more lookups after disabling metrics, got %d", m.lookups)
+	}
+}
+
+func TestRecordArray(t *testing.T) {
+	val := []interface{}{
+		map[string]interface{}{
+			"country": map[string]interface{}{"iso_code": "US", "geoname_id": uint32(6252001)},
+		},
+		map[string]interface{}{
+			"country":  map[string]interface{}{"iso_code": "CA", "geoname_id": uint32(6251999)},
+			"location": map[string]interface{}{"time_zone": "America/Toronto"},
+		},
+	}
+	rec, err := newRecord(val, &options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.CountryCode() != "US" || rec.TimeZone != "America/Toronto" {
+		t.Errorf("unexpected merged record %+v", rec)
+	}
+	if _, err := newRecord([]interface{}{"foo"}, &options{}); err == nil {
+		t.Error("expecting an error for invalid records in array")
+	}
+	// [{}, {"country": {"iso_code": "CA"}}, {"country": {"iso_code": "US"}}]
+	data := []byte{0x03, 0x04, 0xe0}
+	for _, code := range []string{"CA", "US"} {
+		data = append(data, 0xe1, 0x47)
+		data = append(data, "country"...)
+		data = append(data, 0xe1, 0x48)
+		data = append(data, "iso_code"...)
+		data = append(data, 0x42)
+		data = append(data, code...)
+	}
+	db := &database{data: data}
+	if code, err := db.countryCodeAt(16); err != nil || code != "CA" {
+		t.Errorf("expecting country code CA, got %q, %v", code, err)
+	}
+	d := decoder{data, 0}
+	merged, err := d.decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec, err := newRecord(merged, &options{}); err != nil || rec.CountryCode() != "CA" {
+		t.Errorf("expecting merged country code CA, got %+v, %v", rec, err)
+	}
+}
+
+func TestRecordClone(t *testing.T) {
+	geo := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if geo == nil {
+		return
+	}
+	rec, err := geo.Lookup("2.125.160.216")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := rec.Clone()
+	if !reflect.DeepEqual(rec, c) {
+		t.Fatalf("expecting clone to be equal, got %+v", c)
+	}
+	c.Country.Name["en"] = "Changed"
+	c.Subdivisions[0].Code = "XXX"
+	if rec.Country.Name["en"] == "Changed" || rec.Subdivisions[0].Code == "XXX" {
+		t.Error("modifying the clone altered the original record")
+	}
+}
+
+func TestRegisteredDomain(t *testing.T) {
+	cases := map[string]string{
+		"":                        "",
+		"co.uk":                   "",
+		"example.com":             "example.com",
+		"mail.corp.example.co.uk": "example.co.uk",
+		"Host.Example.COM.":       "example.com",
+	}
+	for k, v := range cases {
+		rec := &Record{Domain: k}
+		if d := rec.RegisteredDomain(); d != v {
+			t.Errorf("expecting registered domain %q for %q, got %q", v, k, d)
+		}
+	}
+}
+
+func TestLookupCountryCode(t *testing.T) {
+	geo := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if geo == nil {
+		return
+	}
+	err := geo.current().walk(func(network *net.IPNet, ptr int) error {
+		rec, err := geo.LookupIP(network.IP)
+		if err != nil {
+			return err
+		}
+		code, err := geo.LookupCountryCode(network.IP)
+		if err != nil {
+			return err
+		}
+		if code != rec.CountryCode() {
+			t.Errorf("expecting country code %q for %s, got %q", rec.CountryCode(), network, code)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := net.ParseIP("81.2.69.160")
+	if allocs := testing.AllocsPerRun(100, func() { geo.LookupCountryCode(ip) }); allocs > 1 {
+		t.Errorf("expecting at most 1 allocation, got %v", allocs)
+	}
+}
+
+func TestLookupDomain(t *testing.T) {
+	geo := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if geo == nil {
+		return
+	}
+	// City databases have no domains
+	domain, err := geo.LookupDomain(net.ParseIP("81.2.69.160"))
+	if err != nil || domain != "" {
+		t.Errorf("expecting no domain, got %q, %v", domain, err)
+	}
+	if _, err := geo.LookupDomain(net.ParseIP("127.0.0.1")); err == nil {
+		t.Error("expecting an error for an address not in the database")
+	}
+	// {"domain": "example.com"}
+	data := append([]byte{0xe1, 0x46}, "domain"...)
+	data = append(data, 0x4b)
+	data = append(data, "example.com"...)
+	db := &database{data: data}
+	if domain, err := db.domainAt(16); err != nil || domain != "example.com" {
+		t.Errorf("expecting domain example.com, got %q, %v", domain, err)
+	}
+	rec, err := newRecord(map[string]interface{}{"domain": "example.com"}, &options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Domain != "example.com" {
+		t.Errorf("expecting Record.Domain example.com, got %q", rec.Domain)
+	}
+	// GeoIP2 Enterprise: {"traits": {"domain": "example.org"}}
+	data = append([]byte{0xe1, 0x46}, "traits"...)
+	data = append(data, 0xe1, 0x46)
+	data = append(data, "domain"...)
+	data = append(data, 0x4b)
+	data = append(data, "example.org"...)
+	db = &database{data: data}
+	if domain, err := db.domainAt(16); err != nil || domain != "example.org" {
+		t.Errorf("expecting domain example.org, got %q, %v", domain, err)
+	}
+	// Array-valued records: [{}, {"traits": {"domain": "example.org"}}]
+	db = &database{data: append([]byte{0x02, 0x04, 0xe0}, data...)}
+	if domain, err := db.domainAt(16); err != nil || domain != "example.org" {
+		t.Errorf("expecting domain example.org from array, got %q, %v", domain, err)
+	}
+	// The domain in the traits is decoded even if the traits aren't
+	opts := &options{fields: FieldCountry}
+	d := decoder{data, 0}
+	val, err := d.decodeRecord(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec, err := newRecord(val, opts); err != nil || rec.Domain != "example.org" {
+		t.Errorf("expecting Record.Domain example.org, got %+v, %v", rec, err)
+	}
+}
+
+func TestLookupNetwork(t *testing.T) {
+	geo := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if geo == nil {
+		return
+	}
+	err := geo.current().walk(func(network *net.IPNet, ptr int) error {
+		_, found, err := geo.LookupNetwork(network.IP)
+		if err != nil {
+			return err
+		}
+		if found.String() != network.String() {
+			t.Errorf("expecting network %s for %s, got %s", network, network.IP, found)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []struct {
+		addr    string
+		version int
+	}{
+		{"81.2.69.160", 4},
+		{"::ffff:81.2.69.160", 4},
+		{"2001:218::1", 6},
+	} {
+		rec, network, err := geo.LookupNetwork(net.ParseIP(v.addr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.Country == nil {
+			t.Errorf("expecting a country for %s", v.addr)
+		}
+		version := 6
+		if network.IP.To4() != nil {
+			version = 4
+		}
+		if version != v.version {
+			t.Errorf("expecting IPv%d network for %s, got %s", v.version, v.addr, network)
+		}
+		if !network.Contains(net.ParseIP(v.addr)) {
+			t.Errorf("network %s does not contain %s", network, v.addr)
+		}
+	}
+}
+
+func TestOpenFile(t *testing.T) {
+	for _, v := range []string{"GeoIP2-City-Test.mmdb", "GeoIP2-City-Test.mmdb.gz"} {
+		f, err := os.Open(filepath.Join("testdata", v))
+		if err != nil {
+			if os.IsNotExist(err) {
+				t.Skipf("missing file %s", v)
+			}
+			t.Fatal(err)
+		}
+		// OpenFile must read from the start
+		f.Seek(10, os.SEEK_SET)
+		geo, err := OpenFile(f)
+		f.Close()
+		if err != nil {
+			t.Errorf("error opening %s: %v", v, err)
+			continue
+		}
+		if code, err := geo.LookupCountryCode(net.ParseIP("81.2.69.160")); err != nil || code != "GB" {
+			t.Errorf("expecting GB from %s, got %q (error %v)", v, code, err)
+		}
+	}
+}
+
+func TestCoordinatePrecision(t *testing.T) {
+	data := readFile(t, "GeoIP2-City-Test.mmdb")
+	geo, err := New(bytes.NewReader(data), CoordinatePrecision(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := geo.Lookup("2001:218::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 35.68536, 139.75309 in the source data
+	if rec.Latitude != 35.7 || rec.Longitude != 139.8 {
+		t.Errorf("expecting rounded coordinates 35.7, 139.8, got %v, %v", rec.Latitude, rec.Longitude)
+	}
+}
+
+func TestChangedNetworks(t *testing.T) {
+	a := testNewGeoIP(t, "MaxMind-DB-test-ipv4-24.mmdb")
+	b := testNewGeoIP(t, "MaxMind-DB-test-ipv4-32.mmdb")
+	c := testNewGeoIP(t, "MaxMind-DB-test-mixed-24.mmdb")
+	if a == nil || b == nil || c == nil {
+		return
+	}
+	changed, err := ChangedNetworks(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 0 {
+		t.Errorf("expecting no changes between record sizes, got %v", changed)
+	}
+	// Mixed has different values for the IPv4 networks, plus
+	// the IPv6 ones.
+	changed, err = ChangedNetworks(a, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	has := make(map[string]bool)
+	for _, v := range changed {
+		has[v.String()] = true
+	}
+	for _, v := range []string{"1.1.1.1/32", "::2:0:0/122"} {
+		if !has[v] {
+			t.Errorf("expecting %s to be changed, got %v", v, changed)
+		}
+	}
+}
+
+func TestPlaceConfidence(t *testing.T) {
+	m := map[string]interface{}{
+		"city": map[string]interface{}{
+			"geoname_id": uint32(2643743),
+			"confidence": uint16(25),
+			"names":      map[string]interface{}{"en": "London"},
+		},
+		"country": map[string]interface{}{
+			"geoname_id": uint32(2635167),
+			"iso_code":   "GB",
+		},
+	}
+	rec, err := newRecord(m, &options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.City.Confidence != 25 {
+		t.Errorf("expecting city confidence 25, got %d", rec.City.Confidence)
+	}
+	if rec.Country.Confidence != 0 {
+		t.Errorf("expecting no country confidence, got %d", rec.Country.Confidence)
+	}
+}
+
+func TestRecordConfidence(t *testing.T) {
+	m := map[string]interface{}{
+		"country":      map[string]interface{}{"iso_code": "US", "confidence": uint16(99)},
+		"subdivisions": []interface{}{map[string]interface{}{"iso_code": "CA", "confidence": uint16(80)}},
+		"city":         map[string]interface{}{"geoname_id": uint32(5391959), "confidence": uint16(60)},
+		"postal":       map[string]interface{}{"code": "94107", "confidence": uint16(40)},
+	}
+	rec, err := newRecord(m, &options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Confidence{Country: 99, Subdivision: 80, City: 60, Postal: 40}
+	if c := rec.Confidence(); c != expected {
+		t.Errorf("expecting confidence %+v, got %+v", expected, c)
+	}
+	if c := (&Record{}).Confidence(); c != (Confidence{}) {
+		t.Errorf("expecting zero confidence, got %+v", c)
+	}
+}
+
+func TestIsInEuropeanUnion(t *testing.T) {
+	m := map[string]interface{}{
+		"country":            map[string]interface{}{"iso_code": "DE", "is_in_european_union": true},
+		"registered_country": map[string]interface{}{"iso_code": "CH"},
+	}
+	rec, err := newRecord(m, &options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rec.IsInEuropeanUnion() || !rec.Country.IsInEuropeanUnion {
+		t.Error("expecting country in the European Union")
+	}
+	if rec.RegisteredCountry.IsInEuropeanUnion {
+		t.Error("expecting registered country outside the European Union")
+	}
+	if (&Record{}).IsInEuropeanUnion() {
+		t.Error("expecting record without country outside the European Union")
+	}
+}
+
+func TestBestPlace(t *testing.T) {
+	continent := &Place{Code: "EU"}
+	registered := &Place{Code: "DE"}
+	rec := &Record{Continent: continent, RegisteredCountry: registered}
+	if p := rec.BestPlace(); p != continent {
+		t.Errorf("expecting continent as best place, got %v", p)
+	}
+	if c := rec.BestCountryCode(); c != "DE" {
+		t.Errorf("expecting registered country DE, got %q", c)
+	}
+	if rec.SubdivisionAt(0) != nil {
+		t.Error("expecting no subdivision at level 0")
+	}
+	sub := &Place{Code: "BY"}
+	rec.Subdivisions = []*Place{sub}
+	if rec.SubdivisionAt(0) != sub || rec.SubdivisionAt(1) != nil || rec.SubdivisionAt(-1) != nil {
+		t.Error("unexpected result from SubdivisionAt")
+	}
+	if p := rec.BestPlace(); p != sub {
+		t.Errorf("expecting subdivision as best place, got %v", p)
+	}
+	var nilRec *Record
+	if nilRec.BestPlace() != nil || nilRec.BestCountryCode() != "" {
+		t.Error("expecting empty results for nil record")
+	}
+}
+
+func TestNewSized(t *testing.T) {
+	for _, v := range []string{"GeoIP2-City-Test.mmdb", "GeoIP2-City-Test.mmdb.gz"} {
+		data := readFile(t, v)
+		for _, size := range []int64{int64(len(data)), 0, 10} {
+			geo, err := NewSized(ioutil.NopCloser(bytes.NewReader(data)), size)
+			if err != nil {
+				t.Errorf("error opening %s with size %d: %v", v, size, err)
+				continue
+			}
+			if _, err := geo.Lookup("81.2.69.160"); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	data := readFile(t, "GeoIP2-City-Test.mmdb.gz")
+	var read, total int64
+	progress := ReadProgress(func(r, t int64) { read, total = r, t })
+	if _, err := NewSized(bytes.NewReader(data), int64(len(data)), progress); err != nil {
+		t.Fatal(err)
+	}
+	if read != int64(len(data)) || total != int64(len(data)) {
+		t.Errorf("expecting progress %d/%d, got %d/%d", len(data), len(data), read, total)
+	}
+}
+
+func TestLocalizedNameFallback(t *testing.T) {
+	n := Name{"en": "Japan", "pt-BR": "Japão", "zh-CN": "日本", "de": "Japan"}
+	cases := map[string]string{
+		"zh":         "日本",
+		"zh-CN":      "日本",
+		"zh-TW":      "",
+		"zh-HK":      "",
+		"zh-Hant":    "",
+		"zh_Hant_TW": "",
+		"zh-Hans":    "日本",
+		"pt":         "Japão",
+		"pt-PT":      "Japão",
+		"de-AT":      "Japan",
+		"fr":         "",
+	}
+	for k, v := range cases {
+		if s := n.LocalizedNameFallback(k); s != v {
+			t.Errorf("expecting %q for %s, got %q", v, k, s)
+		}
+	}
+	// LocalizedName only returns exact matches
+	exact := map[string]string{
+		"zh":    "",
+		"zh-CN": "日本",
+		"pt":    "",
+		"pt-BR": "Japão",
+		"de-AT": "",
+		"en":    "Japan",
+	}
+	for k, v := range exact {
+		if s := n.LocalizedName(k); s != v {
+			t.Errorf("expecting exact match %q for %s, got %q", v, k, s)
+		}
+	}
+}
+
+func TestFieldErrors(t *testing.T) {
+	m := map[string]interface{}{
+		"country": map[string]interface{}{
+			"iso_code":   "GB",
+			"geoname_id": "2635167",
+			"names":      map[string]interface{}{"en": "United Kingdom", "de": uint32(1)},
+		},
+		"location":     map[string]interface{}{"latitude": "51.5", "longitude": 0.1, "metro_code": uint16(1)},
+		"subdivisions": "England",
+	}
+	rec, warnings, err := newRecordWarnings(m, &options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.CountryCode() != "GB" || rec.Longitude != 0.1 || rec.MetroCode != 1 {
+		t.Errorf("expecting valid fields to be decoded, got %+v", rec)
+	}
+	fields := make(map[string]bool)
+	for _, v := range warnings {
+		fields[v.(*FieldError).Field] = true
+	}
+	expected := map[string]bool{
+		"country.geoname_id": true,
+		"country.names.de":   true,
+		"location.latitude":  true,
+		"subdivisions":       true,
+	}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("expecting errors in fields %v, got %v", expected, warnings)
+	}
+	if _, err := newRecord(m, &options{}); err != nil {
+		t.Errorf("expecting no error in non-strict mode, got %v", err)
+	}
+	_, err = newRecord(m, &options{strict: true})
+	if de, ok := err.(*DecodeError); !ok || len(de.Errors) != len(expected) {
+		t.Errorf("expecting a *DecodeError in strict mode, got %v", err)
+	}
+}
+
+func TestNoFieldErrors(t *testing.T) {
+	geo := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if geo == nil {
+		return
+	}
+	err := geo.current().walk(func(network *net.IPNet, ptr int) error {
+		_, warnings, err := geo.LookupIPWarnings(network.IP)
+		if err != nil {
+			return err
+		}
+		if len(warnings) > 0 {
+			t.Errorf("unexpected errors decoding %s: %v", network, warnings)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMultiGeoIP(t *testing.T) {
+	city := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	ipv4 := testNewGeoIP(t, "MaxMind-DB-test-ipv4-24.mmdb")
+	if city == nil || ipv4 == nil {
+		return
+	}
+	var _ Lookuper = (*MultiGeoIP)(nil)
+	m := NewMultiGeoIP().Add("ipv4", ipv4).Add("city", city)
+	rec, explained, err := m.LookupExplained(net.ParseIP("81.2.69.160"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.CountryCode() != "GB" {
+		t.Errorf("expecting country GB, got %q", rec.CountryCode())
+	}
+	if explained["Country"] != "city" || explained["City"] != "city" {
+		t.Errorf("expecting country and city from city database, got %v", explained)
+	}
+	if _, ok := explained["Domain"]; ok {
+		t.Errorf("expecting no source for empty fields, got %v", explained)
+	}
+	if !rec.HasCoordinates() || explained["Latitude"] != "city" || explained["Longitude"] != "city" {
+		t.Errorf("expecting coordinates from city database, got %v", explained)
+	}
+	if _, err := m.Lookup("10.0.0.1"); err == nil {
+		t.Error("expecting an error for unknown address")
+	}
+	if _, err := m.Lookup("2001:218::1"); err != nil {
+		t.Errorf("expecting IPv4 databases to be skipped for IPv6 addresses, got %v", err)
+	}
+	broken := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if broken == nil {
+		return
+	}
+	broken.Close()
+	if _, err := m.Add("broken", broken).Lookup("81.2.69.160"); !errors.Is(err, ErrClosed) {
+		t.Errorf("expecting ErrClosed from broken database, got %v", err)
+	}
+	order := specificityOrder([]int{16, 24, 16, 32})
+	if !reflect.DeepEqual(order, []int{3, 1, 0, 2}) {
+		t.Errorf("expecting order [3 1 0 2], got %v", order)
+	}
+}
+
+func TestNameASCII(t *testing.T) {
+	n := Name{"en": "Zürich", "ja": "チューリッヒ", "de": "Zürich", "fr": "Zurich"}
+	cases := map[string]string{
+		"fr": "Zurich",
+		"ja": "Zurich",
+		"de": "Zurich",
+		"ru": "Zurich",
+	}
+	for k, v := range cases {
+		if s := n.ASCII(k); s != v {
+			t.Errorf("expecting %q for %s, got %q", v, k, s)
+		}
+	}
+	if s := (Name{"en": "Łódź Straße"}).ASCII("en"); s != "Lodz Strasse" {
+		t.Errorf("expecting Lodz Strasse, got %q", s)
+	}
+}
+
+func TestCountryNumericCode(t *testing.T) {
+	cases := map[string]int{"US": 840, "GB": 826, "JP": 392, "DE": 276, "XX": 0, "": 0}
+	for k, v := range cases {
+		rec := &Record{Country: &Place{Code: k}}
+		if n := rec.CountryNumericCode(); n != v {
+			t.Errorf("expecting numeric code %d for %q, got %d", v, k, n)
+		}
+	}
+	var rec *Record
+	if rec.CountryNumericCode() != 0 {
+		t.Error("expecting 0 for nil record")
+	}
+}
+
+func TestHasCoordinates(t *testing.T) {
+	geo := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if geo == nil {
+		return
+	}
+	rec, err := geo.Lookup("81.2.69.160")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rec.HasCoordinates() {
+		t.Error("expecting coordinates for 81.2.69.160")
+	}
+	m := map[string]interface{}{
+		"location": map[string]interface{}{
+			"latitude":  0.0,
+			"longitude": 0.0,
+		},
+	}
+	for _, v := range []struct {
+		opts     options
+		expected bool
+	}{
+		{options{}, true},
+		{options{zeroCoordsMissing: true}, false},
+	} {
+		rec, err := newRecord(m, &v.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.HasCoordinates() != v.expected {
+			t.Errorf("expecting HasCoordinates() = %v with zeroCoordsMissing = %v", v.expected, v.opts.zeroCoordsMissing)
+		}
+	}
+	if (&Record{}).HasCoordinates() {
+		t.Error("expecting no coordinates in an empty record")
+	}
+}
+
+func TestCountryBounds(t *testing.T) {
+	geo := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if geo == nil {
+		return
+	}
+	minLat, minLng, maxLat, maxLng, err := geo.CountryBounds("gb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"81.2.69.160", "2.125.160.216"} {
+		rec, err := geo.Lookup(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.Latitude < minLat || rec.Latitude > maxLat || rec.Longitude < minLng || rec.Longitude > maxLng {
+			t.Errorf("%s (%v, %v) is outside of GB bounds (%v, %v, %v, %v)", v, rec.Latitude, rec.Longitude, minLat, minLng, maxLat, maxLng)
+		}
+	}
+	if _, _, _, _, err := geo.CountryBounds("XX"); err == nil {
+		t.Error("expecting an error for an unknown country")
+	}
+}
+
+func TestMemoryUsage(t *testing.T) {
+	geo := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if geo == nil {
+		return
+	}
+	st, err := os.Stat(filepath.Join("testdata", "GeoIP2-City-Test.mmdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the metadata is not kept in memory
+	if usage := geo.MemoryUsage(); usage < st.Size()-int64(maxMetaSize) || usage > st.Size()+1024 {
+		t.Errorf("unexpected memory usage %d for a %d bytes database", usage, st.Size())
+	}
+}
+
+func TestLookupLang(t *testing.T) {
+	geo := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if geo == nil {
+		return
+	}
+	rec, err := geo.LookupLang(net.ParseIP("81.2.69.160"), "de-AT", "zh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := rec.Country.Name
+	if len(names) != 3 || names["en"] == "" || names["de"] == "" || names["zh-CN"] == "" {
+		t.Errorf("expecting en, de and zh-CN country names, got %v", names)
+	}
+	if len(rec.City.Name) > 3 {
+		t.Errorf("expecting at most 3 city names, got %v", rec.City.Name)
+	}
+}
+
+func TestUnsupportedFormatVersion(t *testing.T) {
+	data := readFile(t, "GeoIP2-City-Test.mmdb")
+	key := []byte("binary_format_major_version")
+	p := bytes.LastIndex(data, key)
+	if p < 0 {
+		t.Fatal("binary_format_major_version not found")
+	}
+	// uint16 with size 1: control byte, value
+	p += len(key)
+	if data[p] != 0xa1 || data[p+1] != 2 {
+		t.Fatalf("unexpected encoding for binary_format_major_version: %x", data[p:p+2])
+	}
+	data[p+1] = 3
+	_, err := New(bytes.NewReader(data))
+	if err == nil || !strings.Contains(err.Error(), "unsupported mmdb binary format version 3") {
+		t.Errorf("expecting an unsupported version error, got %v", err)
+	}
+}
+
+func TestSubdivisionsOf(t *testing.T) {
+	geo := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if geo == nil {
+		return
+	}
+	places, err := geo.SubdivisionsOf("gb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for ii, v := range places {
+		if ii > 0 && places[ii-1].Code >= v.Code {
+			t.Errorf("subdivisions are not sorted and distinct: %v", places)
+		}
+		if v.Code == "ENG" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expecting ENG in GB subdivisions, got %v", places)
+	}
+	// Modifying the results must not affect the cache
+	places[0].Code = "XX"
+	again, err := geo.SubdivisionsOf("GB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again[0].Code == "XX" {
+		t.Error("cached subdivisions were modified")
+	}
+	// Invalid countries are not cached
+	if places, err := geo.SubdivisionsOf("not a country"); err != nil || len(places) != 0 {
+		t.Errorf("expecting no subdivisions for an invalid country, got %v, %v", places, err)
+	}
+	db := geo.current()
+	db.mu.Lock()
+	_, cachedValid := db.subdivisions["GB"]
+	_, cachedInvalid := db.subdivisions["NOT A COUNTRY"]
+	db.mu.Unlock()
+	if !cachedValid || cachedInvalid {
+		t.Errorf("expecting only GB to be cached, got %v", db.subdivisions)
+	}
+}
+
+func TestLookupCache(t *testing.T) {
+	data := readFile(t, "GeoIP2-City-Test.mmdb")
+	geo, err := New(bytes.NewReader(data), LookupCache(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ii := 0; ii < 3; ii++ {
+		rec, err := geo.Lookup("81.2.69.160")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.City.Name["en"] != "London" {
+			t.Errorf("expecting London, got %q", rec.City.Name["en"])
+		}
+		// Must not modify the cached record
+		rec.City.Name["en"] = "Paris"
+	}
+	for _, v := range []string{"2.125.160.216", "2001:218::1"} {
+		if _, err := geo.Lookup(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := geo.LookupCacheStats()
+	if expect := (CacheStats{Hits: 2, Misses: 3, Size: 2, Capacity: 2}); stats != expect {
+		t.Errorf("expecting stats %+v, got %+v", expect, stats)
+	}
+	geo.ClearLookupCache()
+	if size := geo.LookupCacheStats().Size; size != 0 {
+		t.Errorf("expecting empty cache after clearing, got %d entries", size)
+	}
+	// Lookups in progress against a replaced database
+	// must not add their records to the cache.
+	old := geo.current()
+	ptr, err := old.lookupIPPointer(net.ParseIP("81.2.69.160"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := geo.ReplaceBytes(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := geo.recordAt(old, ptr); err != nil {
+		t.Fatal(err)
+	}
+	if size := geo.LookupCacheStats().Size; size != 0 {
+		t.Errorf("expecting records from a replaced database not to be cached, got %d entries", size)
+	}
+	if _, err := geo.Lookup("81.2.69.160"); err != nil {
+		t.Fatal(err)
+	}
+	if size := geo.LookupCacheStats().Size; size != 1 {
+		t.Errorf("expecting 1 cached record from the new database, got %d", size)
+	}
+}
+
+func TestOpenWithFallback(t *testing.T) {
+	fallback := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if fallback == nil {
+		return
+	}
+	var buf bytes.Buffer
+	fallback.opts.errorLog = log.New(&buf, "", 0)
+	failing := func() (*GeoIP, error) {
+		return nil, errors.New("no database available")
+	}
+	geo, err := OpenWithFallback(failing, fallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if geo != fallback {
+		t.Error("expecting the fallback database")
+	}
+	if !strings.Contains(buf.String(), "no database available") {
+		t.Errorf("expecting the error to be logged, got %q", buf.String())
+	}
+	if _, err := OpenWithFallback(failing, nil); err == nil {
+		t.Error("expecting an error without fallback")
+	}
+	primary := func() (*GeoIP, error) {
+		return Open(filepath.Join("testdata", "GeoIP2-City-Test.mmdb"))
+	}
+	if geo, err := OpenWithFallback(primary, fallback); err != nil || geo == fallback {
+		t.Errorf("expecting the primary database, got %v, %v", geo, err)
+	}
+}
+
+func TestLookupFull(t *testing.T) {
+	geo := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if geo == nil {
+		return
+	}
+	res, err := geo.LookupFull(net.ParseIP("81.2.69.160"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Found || res.Record == nil || res.Record.CountryCode() != "GB" {
+		t.Errorf("expecting a GB record, got %+v", res)
+	}
+	if !res.BuildTime.Equal(geo.Updated()) || res.BuildTime.IsZero() {
+		t.Errorf("expecting build time %s, got %s", geo.Updated(), res.BuildTime)
+	}
+	if ones, _ := res.Network.Mask.Size(); ones != res.PrefixLen || !res.Network.Contains(net.ParseIP("81.2.69.160")) {
+		t.Errorf("invalid network %s with prefix length %d", res.Network, res.PrefixLen)
+	}
+	res, err = geo.LookupFull(net.ParseIP("127.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Found || res.Record != nil {
+		t.Errorf("expecting no record for 127.0.0.1, got %+v", res)
+	}
+	if res.Network == nil || !res.Network.Contains(net.ParseIP("127.0.0.1")) {
+		t.Errorf("expecting a network containing 127.0.0.1, got %v", res.Network)
+	}
+}
+
+func TestDescription(t *testing.T) {
+	geo := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if geo == nil {
+		return
+	}
+	en := geo.Description("en")
+	if en == "" {
+		t.Fatal("expecting an English description")
+	}
+	if s := geo.Description("xx"); s != en {
+		t.Errorf("expecting English fallback %q, got %q", en, s)
+	}
+	if s := geo.Description("zh"); s == "" {
+		t.Error("expecting a Chinese description")
+	}
+}
+
+func TestCodelessSubdivisions(t *testing.T) {
+	m := map[string]interface{}{
+		"subdivisions": []interface{}{
+			map[string]interface{}{"iso_code": "ENG", "geoname_id": uint32(6269131)},
+			map[string]interface{}{"geoname_id": uint32(1234), "names": map[string]interface{}{"en": "Unofficial"}},
+			map[string]interface{}{"names": map[string]interface{}{"en": "Unknown"}},
+		},
+	}
+	for _, v := range []struct {
+		mode     SubdivisionCodes
+		expected []string
+	}{
+		{SubdivisionCodesKeep, []string{"ENG", "", ""}},
+		{SubdivisionCodesSkip, []string{"ENG"}},
+		{SubdivisionCodesGeonameID, []string{"ENG", "1234"}},
+	} {
+		rec, err := newRecord(m, &options{subdivisionCodes: v.mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var codes []string
+		for _, p := range rec.Subdivisions {
+			codes = append(codes, p.Code)
+		}
+		if !reflect.DeepEqual(codes, v.expected) {
+			t.Errorf("expecting codes %q with mode %d, got %q", v.expected, v.mode, codes)
+		}
+	}
+}
+
+func TestLookupStream(t *testing.T) {
+	geo := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if geo == nil {
+		return
+	}
+	const input = "81.2.69.160\n\n  2001:218::1\nfoo\n"
+	var buf bytes.Buffer
+	if err := geo.LookupStream(strings.NewReader(input), &buf, FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expecting 3 JSON lines, got %q", buf.String())
+	}
+	var res struct {
+		IP     string
+		Record *Record
+		Error  string
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.IP != "81.2.69.160" || res.Record.CountryCode() != "GB" {
+		t.Errorf("unexpected first line %s", lines[0])
+	}
+	if !strings.Contains(lines[2], `"error"`) {
+		t.Errorf("expecting an inline error, got %s", lines[2])
+	}
+	buf.Reset()
+	if err := geo.LookupStream(strings.NewReader(input), &buf, FormatCSV); err != nil {
+		t.Fatal(err)
+	}
+	lines = strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 || lines[0] != "ip,country,subdivision,city,latitude,longitude,error" {
+		t.Fatalf("unexpected CSV output %q", buf.String())
+	}
+	if !strings.HasPrefix(lines[1], "81.2.69.160,GB,ENG,London,") {
+		t.Errorf("unexpected CSV row %q", lines[1])
+	}
+	// Results read before an error must still be written
+	errRead := errors.New("read error")
+	buf.Reset()
+	r := io.MultiReader(strings.NewReader("81.2.69.160\n"), iotest.ErrReader(errRead))
+	if err := geo.LookupStream(r, &buf, FormatJSON); err != errRead {
+		t.Fatalf("expecting read error, got %v", err)
+	}
+	if !strings.Contains(buf.String(), "81.2.69.160") {
+		t.Errorf("expecting results before the error to be flushed, got %q", buf.String())
+	}
+}
+
+func TestDropNames(t *testing.T) {
+	data := readFile(t, "GeoIP2-City-Test.mmdb")
+	geo, err := New(bytes.NewReader(data), DropNames())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := geo.Lookup("81.2.69.160")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Country.Code != "GB" {
+		t.Errorf("expecting country GB, got %q", rec.Country.Code)
+	}
+	if rec.Country.Name != nil || rec.City.Name != nil {
+		t.Errorf("expecting nil names, got %v and %v", rec.Country.Name, rec.City.Name)
+	}
+	if s := rec.City.Name.LocalizedName("en"); s != "" {
+		t.Errorf("expecting empty name, got %q", s)
+	}
+	ip := net.ParseIP("81.2.69.160")
+	dropped := testing.AllocsPerRun(100, func() { geo.LookupIP(ip) })
+	full := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if all := testing.AllocsPerRun(100, func() { full.LookupIP(ip) }); dropped >= all {
+		t.Errorf("expecting fewer allocations with DropNames, got %v vs %v", dropped, all)
+	}
+}
+
+func TestRecordForGeoname(t *testing.T) {
+	geo := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if geo == nil {
+		return
+	}
+	rec, err := geo.Lookup("81.2.69.160")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := geo.RecordForGeoname(rec.City.GeonameID); ok {
+		t.Error("expecting no results before building the index")
+	}
+	if err := geo.BuildGeonameIndex(); err != nil {
+		t.Fatal(err)
+	}
+	city, ok := geo.RecordForGeoname(rec.City.GeonameID)
+	if !ok {
+		t.Fatalf("geoname ID %d not found", rec.City.GeonameID)
+	}
+	if city.City.Name["en"] != "London" || city.CountryCode() != "GB" {
+		t.Errorf("expecting London, GB, got %v, %s", city.City, city.CountryCode())
+	}
+	country, ok := geo.RecordForGeoname(rec.Country.GeonameID)
+	if !ok {
+		t.Fatalf("geoname ID %d not found", rec.Country.GeonameID)
+	}
+	if country.CountryCode() != "GB" || country.City != nil || len(country.Subdivisions) != 0 || country.HasCoordinates() {
+		t.Errorf("expecting only the country and continent, got %+v", country)
+	}
+	if _, ok := geo.RecordForGeoname(-1); ok {
+		t.Error("expecting no record for an unknown geoname ID")
+	}
+	// Places not included by DecodeFields must not be found
+	restricted, err := New(bytes.NewReader(readFile(t, "GeoIP2-City-Test.mmdb")), DecodeFields(FieldCountry))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restricted.BuildGeonameIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if country, ok := restricted.RecordForGeoname(rec.Country.GeonameID); !ok || country.CountryCode() != "GB" {
+		t.Errorf("expecting GB for geoname ID %d, got %v", rec.Country.GeonameID, country)
+	}
+	for _, v := range append([]*Place{rec.City}, rec.Subdivisions...) {
+		if _, ok := restricted.RecordForGeoname(v.GeonameID); ok {
+			t.Errorf("expecting no record for geoname ID %d without decoding its field", v.GeonameID)
+		}
+	}
+}
+
+func TestLookupTimeout(t *testing.T) {
+	data := readFile(t, "GeoIP2-City-Test.mmdb")
+	geo, err := New(bytes.NewReader(data), LookupTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := geo.Lookup("81.2.69.160"); err != nil {
+		t.Error(err)
+	}
+	released := make(chan struct{})
+	geo.setRelease(geo.current(), func() error {
+		close(released)
+		return nil
+	})
+	geo.opts.lookupTimeout = time.Millisecond
+	ip := net.ParseIP("81.2.69.160")
+	block := make(chan struct{})
+	_, err = geo.lookupRecord(ip, func(db *database) (int, error) {
+		<-block
+		return db.lookupIPPointer(ip)
+	})
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expecting a timeout error, got %v", err)
+	}
+	// The stalled lookup keeps the database until it finishes
+	if err := geo.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-released:
+		t.Error("database released while a lookup was using it")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(block)
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Error("database not released after the stalled lookup finished")
+	}
+}
+
+func TestGeoJSON(t *testing.T) {
+	geo := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if geo == nil {
+		return
+	}
+	rec, err := geo.Lookup("81.2.69.160")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := rec.GeoJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var feature struct {
+		Type     string
+		Geometry struct {
+			Type        string
+			Coordinates []float64
+		}
+		Properties map[string]string
+	}
+	if err := json.Unmarshal(data, &feature); err != nil {
+		t.Fatal(err)
+	}
+	if feature.Type != "Feature" || feature.Geometry.Type != "Point" {
+		t.Errorf("unexpected GeoJSON %s", data)
+	}
+	if c := feature.Geometry.Coordinates; len(c) != 2 || c[0] != rec.Longitude || c[1] != rec.Latitude {
+		t.Errorf("unexpected coordinates %v", c)
+	}
+	if feature.Properties["city"] != "London" || feature.Properties["country_code"] != "GB" {
+		t.Errorf("unexpected properties %v", feature.Properties)
+	}
+	empty := &Record{Country: &Place{Code: "GB"}}
+	if _, err := empty.GeoJSON(); err == nil {
+		t.Error("expecting an error for a record without coordinates")
+	}
+	data, err = empty.GeoJSON(GeoJSONNullGeometry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"geometry":null`) {
+		t.Errorf("expecting a null geometry, got %s", data)
+	}
+}
+
+func TestCountryHistogram(t *testing.T) {
+	geo := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if geo == nil {
+		return
+	}
+	var ips []net.IP
+	for _, v := range []string{"81.2.69.160", "2.125.160.216", "2001:218::1", "127.0.0.1"} {
+		ips = append(ips, net.ParseIP(v))
+	}
+	histogram, err := geo.CountryHistogram(ips)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int{"GB": 2, "JP": 1, "": 1}
+	if !reflect.DeepEqual(histogram, expected) {
+		t.Errorf("expecting histogram %v, got %v", expected, histogram)
+	}
+	if _, err := geo.CountryHistogram([]net.IP{nil}); err == nil {
+		t.Error("expecting an error with an invalid IP")
+	}
+}
+
+func TestFlat(t *testing.T) {
+	geo := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if geo == nil {
+		return
+	}
+	rec, err := geo.Lookup("81.2.69.160")
+	if err != nil {
+		t.Fatal(err)
+	}
+	flat := rec.Flat()
+	if flat.CountryISO != "GB" || flat.CountryName != "United Kingdom" || flat.SubdivisionISO != "ENG" || flat.City != "London" {
+		t.Errorf("unexpected flat record %+v", flat)
+	}
+	if flat.Lat != rec.Latitude || flat.Lng != rec.Longitude || flat.TimeZone != rec.TimeZone {
+		t.Errorf("unexpected location in flat record %+v", flat)
+	}
+	m := map[string]interface{}{
+		"autonomous_system_number":       uint32(1221),
+		"autonomous_system_organization": "Telstra Pty Ltd",
+		"isp":                            "Telstra Internet",
+	}
+	rec, err = newRecord(m, &options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flat := rec.Flat(); flat.ASN != 1221 || flat.ASOrganization != "Telstra Pty Ltd" || flat.ISP != "Telstra Internet" {
+		t.Errorf("unexpected ASN and ISP in flat record %+v", flat)
+	}
+}
+
+func TestASNRecord(t *testing.T) {
+	m := map[string]interface{}{
+		"autonomous_system_number":       uint32(15169),
+		"autonomous_system_organization": "Google LLC",
+	}
+	rec, err := newRecord(m, &options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.ASN != 15169 || rec.ASOrganization != "Google LLC" {
+		t.Errorf("unexpected ASN %d and organization %q", rec.ASN, rec.ASOrganization)
+	}
+	// Enterprise databases store them in traits
+	m = map[string]interface{}{
+		"traits": map[string]interface{}{
+			"autonomous_system_number":       uint32(1221),
+			"autonomous_system_organization": "Telstra Pty Ltd",
+		},
+	}
+	rec, err = newRecord(m, &options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.ASN != 1221 || rec.ASOrganization != "Telstra Pty Ltd" {
+		t.Errorf("unexpected ASN %d and organization %q in traits", rec.ASN, rec.ASOrganization)
+	}
+}
+
+func TestISPRecord(t *testing.T) {
+	m := map[string]interface{}{
+		"autonomous_system_number":       uint32(1221),
+		"autonomous_system_organization": "Telstra Pty Ltd",
+		"isp":                            "Telstra Internet",
+		"organization":                   "Telstra Internet",
+	}
+	rec, err := newRecord(m, &options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.ASN != 1221 || rec.ASOrganization != "Telstra Pty Ltd" || rec.ISP != "Telstra Internet" || rec.Organization != "Telstra Internet" {
+		t.Errorf("unexpected ISP record %+v", rec)
+	}
+	// ISP fields are part of FieldTraits
+	rec, err = newRecord(m, &options{fields: FieldCountry})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.ISP != "" || rec.Organization != "" {
+		t.Errorf("expecting no ISP fields without FieldTraits, got %+v", rec)
+	}
+}
+
+func TestConnectionType(t *testing.T) {
+	rec, err := newRecord(map[string]interface{}{"connection_type": "Cellular"}, &options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.ConnectionType != ConnectionTypeCellular {
+		t.Errorf("expecting connection type %q, got %q", ConnectionTypeCellular, rec.ConnectionType)
+	}
+	m := map[string]interface{}{
+		"traits": map[string]interface{}{
+			"connection_type": "Cable/DSL",
+		},
+	}
+	rec, err = newRecord(m, &options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.ConnectionType != ConnectionTypeCableDSL {
+		t.Errorf("expecting connection type %q in traits, got %q", ConnectionTypeCableDSL, rec.ConnectionType)
+	}
+}
+
+func TestLookupAnonymous(t *testing.T) {
+	m := map[string]interface{}{
+		"is_anonymous":     true,
+		"is_anonymous_vpn": true,
+		"is_tor_exit_node": true,
+	}
+	rec, err := newRecord(m, &options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rec.IsAnonymous || !rec.IsAnonymousVPN || !rec.IsTorExitNode || rec.IsPublicProxy {
+		t.Errorf("unexpected anonymous flags in %+v", rec)
+	}
+	if rec.Country != nil || rec.HasCoordinates() {
+		t.Errorf("expecting no geographic data in %+v", rec)
+	}
+	// Enterprise databases store them in traits
+	m = map[string]interface{}{
+		"traits": map[string]interface{}{
+			"is_anonymous":         true,
+			"is_anonymous_vpn":     true,
+			"is_hosting_provider":  true,
+			"is_public_proxy":      true,
+			"is_residential_proxy": true,
+			"is_tor_exit_node":     true,
+		},
+	}
+	rec, err = newRecord(m, &options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rec.IsAnonymous || !rec.IsAnonymousVPN || !rec.IsHostingProvider || !rec.IsPublicProxy || !rec.IsResidentialProxy || !rec.IsTorExitNode {
+		t.Errorf("expecting all anonymous flags from traits in %+v", rec)
+	}
+	geo := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if geo == nil {
+		return
+	}
+	for _, v := range []string{"81.2.69.160", "127.0.0.1"} {
+		info, err := geo.LookupAnonymous(net.ParseIP(v))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info != (AnonymousInfo{}) {
+			t.Errorf("expecting no anonymous flags for %s, got %+v", v, info)
+		}
+	}
+}
+
+func TestSetDefaultLanguages(t *testing.T) {
+	geo := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if geo == nil {
+		return
+	}
+	rec, err := geo.Lookup("81.2.69.160")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := rec.String(); s != "London, England, United Kingdom" {
+		t.Errorf("unexpected record string %q", s)
+	}
+	SetDefaultLanguages("xx", "fr")
+	defer SetDefaultLanguages()
+	if s := rec.Country.String(); s != "Royaume-Uni" {
+		t.Errorf("expecting French country name, got %q", s)
+	}
+	if s := rec.Country.Name.String(); s != "Royaume-Uni" {
+		t.Errorf("expecting French country name from Name.String, got %q", s)
+	}
+	if s := rec.String(); s != "Londres, Angleterre, Royaume-Uni" {
+		t.Errorf("expecting French record string, got %q", s)
+	}
+	if s := rec.Country.Name.LocalizedName(""); s != "" {
+		t.Errorf("expecting no name for empty language, got %q", s)
+	}
+	if flat := rec.Flat(); flat.CountryName != "United Kingdom" {
+		t.Errorf("expecting English names in Flat, got %q", flat.CountryName)
+	}
+	// Falls back to English when there's no French name
+	name := Name{"en": "Foo"}
+	if s := name.String(); s != "Foo" {
+		t.Errorf("expecting English fallback, got %q", s)
+	}
+}
+
+func TestOpenLazy(t *testing.T) {
+	filename := filepath.Join("testdata", "GeoIP2-City-Test.mmdb")
+	if _, err := os.Stat(filename); err != nil {
+		t.Skip(err)
+	}
+	var l Lookuper = OpenLazy(filename, URLDatabaseOpts(DecodeFields(FieldCountry)))
+	var wg sync.WaitGroup
+	for ii := 0; ii < 4; ii++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec, err := l.Lookup("81.2.69.160")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if rec.CountryCode() != "GB" || rec.City != nil {
+				t.Errorf("expecting only the country GB, got %+v", rec)
+			}
+		}()
+	}
+	wg.Wait()
+	missing := OpenLazy(filepath.Join("testdata", "missing.mmdb"))
+	if err := missing.Warmup(); err == nil {
+		t.Error("expecting an error opening a missing file")
+	}
+	if _, err := missing.Lookup("81.2.69.160"); err == nil {
+		t.Error("expecting the open error from Lookup")
+	}
+}
+
+func TestCountryTable(t *testing.T) {
+	geo := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if geo == nil {
+		return
+	}
+	table, err := geo.BuildCountryTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ii := 1; ii < len(table); ii++ {
+		if !table[ii-1].End.Less(table[ii].Start) {
+			t.Fatalf("overlapping or unsorted ranges %v and %v", table[ii-1], table[ii])
+		}
+	}
+	err = geo.current().walk(func(network *net.IPNet, ptr int) error {
+		expected, err := geo.LookupCountryCode(network.IP)
+		if err != nil {
+			return err
+		}
+		if code := table.Lookup(network.IP); code != expected {
+			t.Errorf("expecting country %q for %s, got %q", expected, network.IP, code)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"127.0.0.1", "::1"} {
+		if code := table.Lookup(net.ParseIP(v)); code != "" {
+			t.Errorf("expecting no country for %s, got %q", v, code)
+		}
+	}
+	if code := table.Lookup(net.ParseIP("::ffff:81.2.69.160")); code != "GB" {
+		t.Errorf("expecting GB for IPv4-mapped address, got %q", code)
+	}
+	// IPv4 addresses in a larger IPv6 range
+	wide := CountryTable{{Start: netip.MustParseAddr("::"), End: netip.MustParseAddr("::ffff:ffff:ffff:ffff"), ISO: "ZZ"}}
+	if code := wide.Lookup(net.ParseIP("81.2.69.160")); code != "ZZ" {
+		t.Errorf("expecting ZZ for IPv4 address in IPv6 range, got %q", code)
+	}
+}
+
+func TestCountryTableIPv6Only(t *testing.T) {
+	// IPv6 database without an IPv4 subtree, with a single
+	// network at ::ffff:81.2.69.0/120 for {"country": {"iso_code": "GB"}}
+	const bits = 120
+	network := net.ParseIP("::ffff:81.2.69.0").To16()
+	tree := make([]byte, bits*6)
+	for ii := 0; ii < bits; ii++ {
+		next := ii + 1
+		if ii == bits-1 {
+			next = bits + 16
+		}
+		left, right := next, bits
+		if network[ii/8]&(0x80>>uint(ii%8)) != 0 {
+			left, right = right, left
+		}
+		node := tree[ii*6:]
+		node[0], node[1], node[2] = byte(left>>16), byte(left>>8), byte(left)
+		node[3], node[4], node[5] = byte(right>>16), byte(right>>8), byte(right)
+	}
+	data := append([]byte{0xe1, 0x47}, "country"...)
+	data = append(data, 0xe1, 0x48)
+	data = append(data, "iso_code"...)
+	data = append(data, 0x42)
+	data = append(data, "GB"...)
+	geo := newGeoIP(&database{
+		ipVersion:    6,
+		recordSize:   24,
+		recordBytes:  3,
+		nodeSize:     6,
+		nodeSizeEven: true,
+		nodeCount:    bits,
+		tree:         tree,
+		data:         data,
+	}, nil)
+	if code, err := geo.LookupCountryCode(net.ParseIP("81.2.69.160")); err != nil || code != "GB" {
+		t.Fatalf("expecting GB from the database, got %q, %v", code, err)
+	}
+	table, err := geo.BuildCountryTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(table) != 1 || !table[0].Start.Is4() || !table[0].End.Is4() {
+		t.Errorf("expecting a single IPv4 range, got %v", table)
+	}
+	for _, v := range []string{"81.2.69.160", "::ffff:81.2.69.160"} {
+		if code := table.Lookup(net.ParseIP(v)); code != "GB" {
+			t.Errorf("expecting GB for %s, got %q", v, code)
+		}
+	}
+	if code := table.Lookup(net.ParseIP("81.2.70.1")); code != "" {
+		t.Errorf("expecting no country for 81.2.70.1, got %q", code)
+	}
+}
+
+func TestCoordinatesForPlace(t *testing.T) {
+	geo := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if geo == nil {
+		return
+	}
+	rec, err := geo.Lookup("81.2.69.160")
+	if err != nil {
+		t.Fatal(err)
+	}
+	coords, ok, err := geo.CoordinatesForPlace("gb", "eng", "london")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("London not found")
+	}
+	if coords.Lat != rec.Latitude || coords.Lng != rec.Longitude {
+		t.Errorf("expecting coordinates (%v, %v), got %+v", rec.Latitude, rec.Longitude, coords)
+	}
+	if _, ok, err := geo.CoordinatesForPlace("GB", "", "Atlantis"); err != nil || ok {
+		t.Errorf("expecting no coordinates for Atlantis, got %v, %v", ok, err)
+	}
+}
+
+func TestLookupLazy(t *testing.T) {
+	geo := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if geo == nil {
+		return
+	}
+	ip := net.ParseIP("81.2.69.160")
+	rec, err := geo.LookupIP(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lazy, err := geo.LookupLazy(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lazy.CountryCode() != "GB" || !reflect.DeepEqual(lazy.Country(), rec.Country) {
+		t.Errorf("expecting country %v, got %v", rec.Country, lazy.Country())
+	}
+	if lazy.Country() != lazy.Country() {
+		t.Error("expecting the decoded country to be cached")
+	}
+	if !reflect.DeepEqual(lazy.City(), rec.City) || !reflect.DeepEqual(lazy.Subdivisions(), rec.Subdivisions) {
+		t.Errorf("unexpected city %v or subdivisions %v", lazy.City(), lazy.Subdivisions())
+	}
+	coords, ok := lazy.Coordinates()
+	if !ok || coords.Lat != rec.Latitude || coords.Lng != rec.Longitude {
+		t.Errorf("unexpected coordinates %+v", coords)
+	}
+	full, err := lazy.Record()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(full, rec) {
+		t.Errorf("expecting record %+v, got %+v", rec, full)
+	}
+}
+
+func TestReplaceBytes(t *testing.T) {
+	data := readFile(t, "GeoIP2-City-Test.mmdb")
+	geo, err := New(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := geo.Updated()
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := geo.Lookup("81.2.69.160"); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	if err := geo.ReplaceBytes(newerDatabase(t, data)); err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	wg.Wait()
+	if !geo.Updated().After(old) {
+		t.Errorf("expecting a newer database, got one built at %s", geo.Updated())
+	}
+	updated := geo.Updated()
+	if err := geo.ReplaceBytes([]byte("not a database")); err == nil {
+		t.Error("expecting an error with an invalid database")
+	}
+	if !geo.Updated().Equal(updated) {
+		t.Error("invalid data replaced the database")
+	}
+	if _, err := geo.Lookup("81.2.69.160"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFlagForCountryCode(t *testing.T) {
+	for _, v := range []struct {
+		iso  string
+		flag string
+	}{
+		{"GB", "🇬🇧"},
+		{"jp", "🇯🇵"},
+		{"", ""},
+		{"USA", ""},
+		{"1A", ""},
+	} {
+		if flag := FlagForCountryCode(v.iso); flag != v.flag {
+			t.Errorf("expecting flag %q for %q, got %q", v.flag, v.iso, flag)
+		}
+	}
+	rec := &Record{Country: &Place{Code: "US"}}
+	if flag := rec.CountryFlag(); flag != "🇺🇸" {
+		t.Errorf("expecting US flag, got %q", flag)
+	}
+	if flag := (&Record{}).CountryFlag(); flag != "" {
+		t.Errorf("expecting no flag, got %q", flag)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted := RequestTrustedProxies("10.0.0.0/8", "192.0.2.1")
+	cases := []struct {
+		remote  string
+		headers map[string]string
+		opts    []RequestOpt
+		ip      string
+	}{
+		{"81.2.69.160:1234", nil, nil, "81.2.69.160"},
+		// Headers from untrusted clients are ignored
+		{"81.2.69.160:1234", map[string]string{"X-Forwarded-For": "1.2.3.4"}, nil, "81.2.69.160"},
+		{"81.2.69.160:1234", map[string]string{"X-Forwarded-For": "1.2.3.4"}, []RequestOpt{trusted}, "81.2.69.160"},
+		{"10.0.0.1:1234", map[string]string{"X-Forwarded-For": "81.2.69.160"}, []RequestOpt{trusted}, "81.2.69.160"},
+		// Spoofed addresses before the client one are ignored
+		{"10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.2.3.4, 81.2.69.160, 192.0.2.1"}, []RequestOpt{trusted}, "81.2.69.160"},
+		{"10.0.0.1:1234", map[string]string{"X-Real-IP": "81.2.69.160"}, []RequestOpt{trusted}, "81.2.69.160"},
+		{"[::ffff:10.0.0.1]:1234", map[string]string{"Forwarded": `for=1.2.3.4, for="[2001:db8::1]:4711";proto=https`, "X-Forwarded-For": "5.6.7.8"}, []RequestOpt{trusted}, "2001:db8::1"},
+		{"10.0.0.1:1234", map[string]string{"Forwarded": "for=81.2.69.160:80;by=10.0.0.1"}, []RequestOpt{trusted}, "81.2.69.160"},
+	}
+	for _, v := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = v.remote
+		for k, h := range v.headers {
+			r.Header.Set(k, h)
+		}
+		ip, err := ClientIP(r, v.opts...)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !ip.Equal(net.ParseIP(v.ip)) {
+			t.Errorf("expecting client IP %s for %s with headers %v, got %s", v.ip, v.remote, v.headers, ip)
+		}
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	if _, err := ClientIP(r, RequestTrustedProxies("invalid")); err == nil {
+		t.Error("expecting an error for an invalid trusted proxy")
+	}
+	geo := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if geo == nil {
+		return
+	}
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "81.2.69.160")
+	rec, err := geo.LookupRequest(r, trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.CountryCode() != "GB" {
+		t.Errorf("expecting country GB, got %q", rec.CountryCode())
+	}
+}
+
+func TestLookupHost(t *testing.T) {
+	geo, err := New(bytes.NewReader(readFile(t, "GeoIP2-City-Test.mmdb")), HostResolver(&net.Resolver{PreferGo: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := geo.LookupHost(context.Background(), "81.2.69.160")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Record.CountryCode() != "GB" {
+		t.Errorf("unexpected records %+v", records)
+	}
+	// Resolved from /etc/hosts, but not in the database
+	records, err = geo.LookupHost(context.Background(), "localhost")
+	if err != nil {
+		t.Skipf("can't resolve localhost: %v", err)
+	}
+	for _, v := range records {
+		if !v.IP.IsLoopback() || v.Record != nil {
+			t.Errorf("unexpected record %+v for localhost", v)
+		}
+	}
+}
+
+func TestLookupInto(t *testing.T) {
+	geo := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if geo == nil {
+		return
+	}
+	type place struct {
+		GeonameID uint              `maxminddb:"geoname_id"`
+		ISOCode   string            `maxminddb:"iso_code"`
+		Names     map[string]string `maxminddb:"names"`
+	}
+	var rec struct {
+		Country      place   `maxminddb:"country"`
+		City         *place  `maxminddb:"city"`
+		Subdivisions []place `maxminddb:"subdivisions"`
+		Location     struct {
+			Latitude  float64 `maxminddb:"latitude"`
+			Longitude float64 `maxminddb:"longitude"`
+			TimeZone  string  `maxminddb:"time_zone"`
+		} `maxminddb:"location"`
+		Ignored string `maxminddb:"-"`
+	}
+	ip := net.ParseIP("81.2.69.160")
+	if err := geo.LookupInto(ip, &rec); err != nil {
+		t.Fatal(err)
+	}
+	expected, err := geo.LookupIP(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Country.ISOCode != expected.CountryCode() || int(rec.Country.GeonameID) != expected.Country.GeonameID {
+		t.Errorf("expecting country %+v, got %+v", expected.Country, rec.Country)
+	}
+	if rec.City == nil || rec.City.Names["en"] != expected.City.Name["en"] {
+		t.Errorf("expecting city %+v, got %+v", expected.City, rec.City)
+	}
+	if len(rec.Subdivisions) != len(expected.Subdivisions) || rec.Subdivisions[0].ISOCode != expected.Subdivisions[0].Code {
+		t.Errorf("expecting subdivisions %+v, got %+v", expected.Subdivisions, rec.Subdivisions)
+	}
+	if rec.Location.Latitude != expected.Latitude || rec.Location.Longitude != expected.Longitude || rec.Location.TimeZone != expected.TimeZone {
+		t.Errorf("unexpected location %+v", rec.Location)
+	}
+	var mismatch struct {
+		Country string `maxminddb:"country"`
+	}
+	if err := geo.LookupInto(ip, &mismatch); err == nil {
+		t.Error("expecting an error when decoding a map into a string")
+	}
+	var wrongContainer struct {
+		Country []string `maxminddb:"country"`
+	}
+	if err := geo.LookupInto(ip, &wrongContainer); err == nil {
+		t.Error("expecting an error when decoding a map into a slice")
+	}
+	var value map[string]interface{}
+	if err := geo.LookupInto(ip, &value); err != nil {
+		t.Fatal(err)
+	}
+	if raw, _ := geo.LookupIPValue(ip); !reflect.DeepEqual(raw, value) {
+		t.Errorf("expecting raw value %v, got %v", raw, value)
+	}
+	if err := geo.LookupInto(ip, rec); err == nil {
+		t.Error("expecting an error for a non-pointer")
+	}
+	if err := geo.LookupInto(net.ParseIP("127.0.0.1"), &rec); err == nil {
+		t.Error("expecting an error for an address not in the database")
+	}
+}
+
+func TestDecodeRecord(t *testing.T) {
+	optsList := []*options{
+		{},
+		{fields: FieldCountry},
+		{fields: FieldCity | FieldLocation},
+		{fields: FieldTraits},
+		{dropNames: true},
+		{fields: FieldSubdivisions, dropNames: true},
+	}
+	for _, name := range []string{"GeoIP2-City-Test.mmdb", "MaxMind-DB-test-decoder.mmdb", "MaxMind-DB-test-nested.mmdb"} {
+		geo := testNewGeoIP(t, name)
+		if geo == nil {
+			continue
+		}
+		db := geo.current()
+		err := db.walk(func(network *net.IPNet, ptr int) error {
+			raw, err := db.lookupResult(ptr)
+			if err != nil {
+				return err
+			}
+			for _, opts := range optsList {
+				val, err := db.recordValue(ptr, opts)
+				if err != nil {
+					return err
+				}
+				rec, rerr := newRecord(val, opts)
+				expected, eerr := newRecord(raw, opts)
+				if (rerr != nil) != (eerr != nil) {
+					t.Errorf("%s %s: expecting error %v, got %v", name, network, eerr, rerr)
+					continue
+				}
+				if !reflect.DeepEqual(rec, expected) {
+					t.Errorf("%s %s with %+v: expecting %+v, got %+v", name, network, opts, expected, rec)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	full := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if full == nil {
+		return
+	}
+	country, err := New(bytes.NewReader(readFile(t, "GeoIP2-City-Test.mmdb")), DecodeFields(FieldCountry))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := net.ParseIP("81.2.69.160")
+	fullAllocs := testing.AllocsPerRun(100, func() { full.LookupIP(ip) })
+	countryAllocs := testing.AllocsPerRun(100, func() { country.LookupIP(ip) })
+	if countryAllocs*2 > fullAllocs {
+		t.Errorf("expecting country lookups to allocate less than half of full lookups, got %v vs %v", countryAllocs, fullAllocs)
+	}
+}
+
+func TestNetworks(t *testing.T) {
+	geo := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if geo == nil {
+		return
+	}
+	var prev netip.Prefix
+	count := 0
+	err := geo.Networks(func(network netip.Prefix, rec *Record) error {
+		if prev.IsValid() && network.Addr().Is4() == prev.Addr().Is4() && !prev.Addr().Less(network.Addr()) {
+			t.Errorf("network %s reported after %s", network, prev)
+		}
+		if network.Masked() != network {
+			t.Errorf("network %s is not masked", network)
+		}
+		expected, err := geo.LookupAddr(network.Addr())
+		if err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(rec, expected) {
+			t.Errorf("expecting record %+v for %s, got %+v", expected, network, rec)
+		}
+		prev = network
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count == 0 {
+		t.Error("no networks reported")
+	}
+	errStop := errors.New("stop")
+	calls := 0
+	err = geo.Networks(func(netip.Prefix, *Record) error {
+		calls++
+		return errStop
+	})
+	if err != errStop || calls != 1 {
+		t.Errorf("expecting the walk to stop with errStop after 1 call, got %v after %d", err, calls)
+	}
+}
+
+func TestNetworksWithin(t *testing.T) {
+	for _, name := range []string{"GeoIP2-City-Test.mmdb", "MaxMind-DB-test-ipv4-24.mmdb", "MaxMind-DB-test-mixed-24.mmdb"} {
+		geo := testNewGeoIP(t, name)
+		if geo == nil {
+			continue
+		}
+		var all []netip.Prefix
+		if err := geo.Networks(func(network netip.Prefix, _ *Record) error {
+			all = append(all, network)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range []string{"0.0.0.0/0", "1.1.1.0/24", "1.1.1.1/32", "81.2.69.0/24", "2001:218::/32", "::/0"} {
+			within := netip.MustParsePrefix(v)
+			var expected []netip.Prefix
+			for _, n := range all {
+				if within.Overlaps(n) && n.Addr().Is4() == within.Addr().Is4() {
+					expected = append(expected, n)
+				}
+			}
+			var got []netip.Prefix
+			err := geo.NetworksWithin(within, func(network netip.Prefix, rec *Record) error {
+				got = append(got, network)
+				return nil
+			})
+			if err != nil {
+				if geo.IPVersion() == 4 && within.Addr().Is6() {
+					continue
+				}
+				t.Errorf("%s: error walking %s: %v", name, within, err)
+				continue
+			}
+			if within.Bits() == 0 && within.Addr().Is6() {
+				// ::/0 includes the IPv4 networks too
+				expected = all
+			}
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("%s: expecting networks %v within %s, got %v", name, expected, within, got)
+			}
+		}
+	}
+}
+
+func TestOpenMmap(t *testing.T) {
+	for _, name := range []string{"GeoIP2-City-Test.mmdb", "MaxMind-DB-test-ipv4-24.mmdb", "MaxMind-DB-test-mixed-32.mmdb"} {
+		filename := filepath.Join("testdata", name)
+		mapped, err := OpenMmap(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer mapped.Close()
+		geo := testNewGeoIP(t, name)
+		if geo == nil {
+			continue
+		}
+		if mapped.MemoryUsage() != geo.MemoryUsage() {
+			t.Errorf("%s: expecting memory usage %d, got %d", name, geo.MemoryUsage(), mapped.MemoryUsage())
+		}
+		err = geo.Networks(func(network netip.Prefix, rec *Record) error {
+			mrec, err := mapped.LookupAddr(network.Addr())
+			if err != nil {
+				return err
+			}
+			if !reflect.DeepEqual(rec, mrec) {
+				t.Errorf("%s: expecting record %+v for %s, got %+v", name, rec, network, mrec)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := OpenMmap(filepath.Join("testdata", "GeoIP2-City-Test.mmdb.gz")); err == nil {
+		t.Error("expecting an error when mapping a compressed database")
+	}
+	if _, err := OpenMmap(filepath.Join("testdata", "README.md")); err == nil {
+		t.Error("expecting an error when mapping an invalid database")
+	}
+}
+
+func TestReloadMmap(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "GeoIP.mmdb")
+	if err := ioutil.WriteFile(filename, readFile(t, "MaxMind-DB-test-ipv4-24.mmdb"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	geo, err := OpenMmap(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer geo.Close()
+	// Replace the file with a rename, like geoipupdate does
+	tmp := filepath.Join(filepath.Dir(filename), "GeoIP.tmp")
+	if err := ioutil.WriteFile(tmp, readFile(t, "GeoIP2-City-Test.mmdb"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		t.Fatal(err)
+	}
+	prev := geo.releaser
+	if err := geo.Reload(filename); err != nil {
+		t.Fatal(err)
+	}
+	if geo.releaser == prev || geo.releaser.release == nil || geo.current().releaser != geo.releaser {
+		t.Error("expecting the reloaded database to be mapped")
+	}
+	if !prev.retired || prev.release == nil {
+		t.Error("expecting the previous mapping to be retired")
+	}
+	if rec, err := geo.Lookup("81.2.69.160"); err != nil || rec.CountryCode() != "GB" {
+		t.Errorf("expecting country GB after reloading, got %+v, %v", rec, err)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	prev = geo.releaser
+	if err := geo.ReloadFrom(f); err != nil {
+		t.Fatal(err)
+	}
+	if geo.releaser == prev || geo.current().releaser != geo.releaser {
+		t.Error("expecting ReloadFrom to map an *os.File")
+	}
+	// Compressed databases are read into memory
+	if err := geo.Reload(filepath.Join("testdata", "GeoIP2-City-Test.mmdb.gz")); err != nil {
+		t.Fatal(err)
+	}
+	if err := geo.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if geo.releaser.release != nil {
+		t.Error("expecting the current mapping to be released by Close")
+	}
+}
+
+func TestNewFromBytes(t *testing.T) {
+	data := readFile(t, "GeoIP2-City-Test.mmdb")
+	geo, err := NewFromBytes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db := geo.current(); &db.tree[0] != &data[0] {
+		t.Error("database data was copied")
+	}
+	rec, err := geo.Lookup("81.2.69.160")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.CountryCode() != "GB" {
+		t.Errorf("expecting country GB, got %q", rec.CountryCode())
+	}
+	compressed, err := NewFromBytes(readFile(t, "GeoIP2-City-Test.mmdb.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if crec, err := compressed.Lookup("81.2.69.160"); err != nil || !reflect.DeepEqual(rec, crec) {
+		t.Errorf("expecting record %+v from compressed database, got %+v (%v)", rec, crec, err)
+	}
+	for _, v := range [][]byte{nil, []byte("foo"), data[:len(data)/2]} {
+		if _, err := NewFromBytes(v); err == nil {
+			t.Errorf("expecting an error for invalid database of %d bytes", len(v))
+		}
+	}
+}
+
+func TestOpenFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"db/city.mmdb":    {Data: readFile(t, "GeoIP2-City-Test.mmdb")},
+		"db/city.mmdb.gz": {Data: readFile(t, "GeoIP2-City-Test.mmdb.gz")},
+	}
+	for _, name := range []string{"db/city.mmdb", "db/city.mmdb.gz"} {
+		geo, err := OpenFS(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec, err := geo.Lookup("81.2.69.160")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.CountryCode() != "GB" {
+			t.Errorf("%s: expecting country GB, got %q", name, rec.CountryCode())
+		}
+	}
+	if _, err := OpenFS(fsys, "db/missing.mmdb"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expecting fs.ErrNotExist, got %v", err)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	geo := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if geo == nil {
+		return
+	}
+	m := geo.Metadata()
+	// Older test databases use spaces
+	if m.DatabaseType != "GeoIP2 City" {
+		t.Errorf("expecting database type GeoIP2 City, got %q", m.DatabaseType)
+	}
+	if m.IPVersion != 6 || m.RecordSize != 28 || m.NodeCount == 0 || m.BinaryFormatMajorVersion != 2 {
+		t.Errorf("unexpected metadata %+v", m)
+	}
+	if !m.BuildTime().Equal(geo.Updated()) {
+		t.Errorf("expecting build time %v, got %v", geo.Updated(), m.BuildTime())
+	}
+	if m.Description["en"] != geo.Description("en") || len(m.Languages) == 0 {
+		t.Errorf("unexpected description and languages in %+v", m)
+	}
+}
+
+func TestClose(t *testing.T) {
+	mapped, err := OpenMmap(filepath.Join("testdata", "GeoIP2-City-Test.mmdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	geo := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if geo == nil {
+		return
+	}
+	for _, g := range []*GeoIP{mapped, geo} {
+		if _, err := g.Lookup("81.2.69.160"); err != nil {
+			t.Fatal(err)
+		}
+		if err := g.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if g.releaser != nil && g.releaser.release != nil {
+			t.Error("release function was not cleared")
+		}
+		if _, err := g.Lookup("81.2.69.160"); err != ErrClosed {
+			t.Errorf("expecting ErrClosed, got %v", err)
+		}
+		if _, err := g.LookupAddr(netip.MustParseAddr("81.2.69.160")); err != ErrClosed {
+			t.Errorf("expecting ErrClosed from LookupAddr, got %v", err)
+		}
+		if err := g.Networks(func(netip.Prefix, *Record) error { return nil }); err != ErrClosed {
+			t.Errorf("expecting ErrClosed from Networks, got %v", err)
+		}
+		if err := g.NetworksWithin(netip.MustParsePrefix("81.2.69.0/24"), func(netip.Prefix, *Record) error { return nil }); err != ErrClosed {
+			t.Errorf("expecting ErrClosed from NetworksWithin, got %v", err)
+		}
+		if err := g.ReplaceBytes(readFile(t, "GeoIP2-City-Test.mmdb")); err != ErrClosed {
+			t.Errorf("expecting ErrClosed from ReplaceBytes, got %v", err)
+		}
+		if err := g.Close(); err != nil {
+			t.Errorf("expecting no error closing twice, got %v", err)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	geo := testNewGeoIP(t, "MaxMind-DB-test-ipv4-24.mmdb")
+	if geo == nil {
+		return
+	}
+	if _, err := geo.Lookup("81.2.69.160"); err == nil {
+		t.Fatal("expecting an error before reloading")
+	}
+	if err := geo.Reload(filepath.Join("testdata", "GeoIP2-City-Test.mmdb.gz")); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := geo.Lookup("81.2.69.160")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.CountryCode() != "GB" {
+		t.Errorf("expecting country GB after reloading, got %q", rec.CountryCode())
+	}
+	if err := geo.Reload(filepath.Join("testdata", "missing.mmdb")); err == nil {
+		t.Error("expecting an error reloading a missing file")
+	}
+	if err := geo.ReloadFrom(strings.NewReader("invalid")); err == nil {
+		t.Error("expecting an error reloading an invalid database")
+	}
+	// Previous database is kept on errors
+	if _, err := geo.Lookup("81.2.69.160"); err != nil {
+		t.Error(err)
+	}
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for ii := 0; ii < 4; ii++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if _, err := geo.Lookup("81.2.69.160"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	data := readFile(t, "GeoIP2-City-Test.mmdb")
+	for ii := 0; ii < 10; ii++ {
+		if err := geo.ReloadFrom(bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestWatchFile(t *testing.T) {
+	defer func(d time.Duration) { watchDelay = d }(watchDelay)
+	watchDelay = 10 * time.Millisecond
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "GeoIP.mmdb")
+	if err := ioutil.WriteFile(filename, readFile(t, "MaxMind-DB-test-ipv4-24.mmdb"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := make(chan error, 10)
+	geo, err := Open(filename, WatchFile(func(err error) { reloaded <- err }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer geo.Close()
+	wait := func() error {
+		select {
+		case err := <-reloaded:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("database was not reloaded")
+		}
+		return nil
+	}
+	// Replace the file with a rename, like geoipupdate does
+	tmp := filepath.Join(dir, "GeoIP.mmdb.tmp")
+	if err := ioutil.WriteFile(tmp, readFile(t, "GeoIP2-City-Test.mmdb"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		t.Fatal(err)
+	}
+	if err := wait(); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := geo.Lookup("81.2.69.160")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.CountryCode() != "GB" {
+		t.Errorf("expecting country GB after reloading, got %q", rec.CountryCode())
+	}
+	// Invalid databases are reported and the previous one is kept
+	if err := ioutil.WriteFile(filename, []byte("invalid"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := wait(); err == nil {
+		t.Error("expecting an error reloading an invalid database")
+	}
+	if _, err := geo.Lookup("81.2.69.160"); err != nil {
+		t.Error(err)
+	}
+	if err := geo.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackgroundReloadMmap(t *testing.T) {
+	defer func(d time.Duration) { watchDelay = d }(watchDelay)
+	watchDelay = 10 * time.Millisecond
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "GeoIP.mmdb")
+	if err := ioutil.WriteFile(filename, readFile(t, "MaxMind-DB-test-ipv4-24.mmdb"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := make(chan error, 10)
+	geo, err := OpenMmap(filename, WatchFile(func(err error) { reloaded <- err }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer geo.Close()
+	wait := func() {
+		select {
+		case err := <-reloaded:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("database was not reloaded")
+		}
+	}
+	current := func() *releaser {
+		geo.mu.Lock()
+		defer geo.mu.Unlock()
+		return geo.releaser
+	}
+	mapped := func(prev *releaser) {
+		if r := current(); r == prev || geo.current().releaser != r {
+			t.Error("expecting the reloaded database to be mapped")
+		}
+	}
+	// Mapped files must be replaced with a rename
+	tmp := filepath.Join(dir, "GeoIP.mmdb.tmp")
+	if err := ioutil.WriteFile(tmp, readFile(t, "GeoIP2-City-Test.mmdb"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	prev := current()
+	if err := os.Rename(tmp, filename); err != nil {
+		t.Fatal(err)
+	}
+	wait()
+	mapped(prev)
+	if runtime.GOOS == "windows" {
+		return
+	}
+	if err := geo.ReloadOnSignal(func(err error) { reloaded <- err }, syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	prev = current()
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Signal(syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	wait()
+	mapped(prev)
+}
+
+func TestWatchFileCloseFromCallback(t *testing.T) {
+	defer func(d time.Duration) { watchDelay = d }(watchDelay)
+	watchDelay = 10 * time.Millisecond
+	filename := filepath.Join(t.TempDir(), "GeoIP.mmdb")
+	if err := ioutil.WriteFile(filename, readFile(t, "MaxMind-DB-test-ipv4-24.mmdb"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan error, 1)
+	var geo *GeoIP
+	geo, err := Open(filename, WatchFile(func(err error) { closed <- geo.Close() }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, readFile(t, "GeoIP2-City-Test.mmdb"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("closing from the callback deadlocked")
+	}
+	if _, err := geo.Lookup("81.2.69.160"); err != ErrClosed {
+		t.Errorf("expecting ErrClosed, got %v", err)
+	}
+}
+
+func TestReloadOnSignal(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sending signals is not supported on windows")
+	}
+	if err := new(GeoIP).ReloadOnSignal(nil); err == nil {
+		t.Error("expecting an error for a database without a source")
+	}
+	filename := filepath.Join(t.TempDir(), "GeoIP.mmdb")
+	if err := ioutil.WriteFile(filename, readFile(t, "MaxMind-DB-test-ipv4-24.mmdb"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	geo, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer geo.Close()
+	reloaded := make(chan error, 1)
+	if err := geo.ReloadOnSignal(func(err error) { reloaded <- err }, syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, readFile(t, "GeoIP2-City-Test.mmdb"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Signal(syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-reloaded:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("database was not reloaded")
+	}
+	if _, err := geo.Lookup("81.2.69.160"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOpenUnreachable(t *testing.T) {
+	// Databases with a known source must not reference themselves,
+	// otherwise the GeoIP might never be collected.
+	filename := filepath.Join("testdata", "GeoIP2-City-Test.mmdb")
+	collected := make(chan struct{}, 1)
+	func() {
+		geo, err := OpenMmap(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if geo.source == nil {
+			t.Fatal("expecting a source for a database opened by name")
+		}
+		runtime.SetFinalizer(geo, func(*GeoIP) { collected <- struct{}{} })
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		runtime.GC()
+		select {
+		case <-collected:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("GeoIP was not collected")
+		}
+	}
+}
+
+func TestReleaseFinalizer(t *testing.T) {
+	released := make(chan struct{}, 1)
+	var res *Result
+	func() {
+		geo, err := NewFromBytes(readFile(t, "GeoIP2-City-Test.mmdb"), ErrorLog(log.New(ioutil.Discard, "", 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		geo.setRelease(geo.current(), func() error {
+			released <- struct{}{}
+			return nil
+		})
+		if res, err = geo.LookupDecoder(net.ParseIP("81.2.69.160")); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	// The Result keeps the database alive, even if
+	// the GeoIP is not reachable anymore.
+	for ii := 0; ii < 3; ii++ {
+		runtime.GC()
+	}
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case <-released:
+		t.Fatal("database released while a Result was using it")
+	default:
+	}
+	if _, err := res.Value(); err != nil {
+		t.Fatal(err)
+	}
+	res = nil
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		runtime.GC()
+		select {
+		case <-released:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("database was not released by the finalizer")
+		}
+	}
+}
+
+func TestKeyEqualsCorrupted(t *testing.T) {
+	// A 5 bytes string with only 2 bytes of data
+	d := decoder{data: []byte{0x45, 'a', 'b'}}
+	if _, err := d.keyEquals("abcde"); err == nil {
+		t.Error("expecting an error for a truncated key")
+	}
+}
@@ -0,0 +1,93 @@
+package geoip
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+var errNoCoordinates = errors.New("record has no coordinates")
+
+type geoJSONOptions struct {
+	nullGeometry bool
+}
+
+// GeoJSONOpt is a function type which allows setting options
+// for Record.GeoJSON. See GeoJSONNullGeometry.
+type GeoJSONOpt func(*geoJSONOptions)
+
+// GeoJSONNullGeometry makes Record.GeoJSON return a Feature with
+// a null geometry for records without coordinates, rather than
+// an error.
+func GeoJSONNullGeometry() GeoJSONOpt {
+	return func(opts *geoJSONOptions) {
+		opts.nullGeometry = true
+	}
+}
+
+type geoJSONPoint struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+type geoJSONFeature struct {
+	Type       string            `json:"type"`
+	Geometry   *geoJSONPoint     `json:"geometry"`
+	Properties map[string]string `json:"properties"`
+}
+
+// GeoJSON returns r encoded as a GeoJSON Feature with a Point geometry
+// at its coordinates, which can be used directly by mapping tools (e.g.
+// Leaflet or Mapbox). The English names and the codes of the continent,
+// country, largest subdivision and city, as well as the time zone and
+// postal code, are included in the properties object when available. If
+// r has no coordinates (see HasCoordinates), an error is returned unless
+// GeoJSONNullGeometry is used.
+func (r *Record) GeoJSON(opts ...GeoJSONOpt) ([]byte, error) {
+	var o geoJSONOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	feature := geoJSONFeature{
+		Type:       "Feature",
+		Properties: make(map[string]string),
+	}
+	if r.HasCoordinates() {
+		feature.Geometry = &geoJSONPoint{
+			Type: "Point",
+			// GeoJSON uses longitude, latitude order
+			Coordinates: [2]float64{r.Longitude, r.Latitude},
+		}
+	} else if !o.nullGeometry {
+		return nil, errNoCoordinates
+	}
+	if r == nil {
+		return json.Marshal(feature)
+	}
+	places := []struct {
+		key   string
+		place *Place
+	}{
+		{"continent", r.Continent},
+		{"country", r.Country},
+		{"subdivision", r.SubdivisionAt(0)},
+		{"city", r.City},
+	}
+	for _, v := range places {
+		if v.place == nil {
+			continue
+		}
+		if name := v.place.Name["en"]; name != "" {
+			feature.Properties[v.key] = name
+		}
+		if v.place.Code != "" {
+			feature.Properties[v.key+"_code"] = v.place.Code
+		}
+	}
+	if r.TimeZone != "" {
+		feature.Properties["time_zone"] = r.TimeZone
+	}
+	if r.PostalCode != "" {
+		feature.Properties["postal_code"] = r.PostalCode
+	}
+	return json.Marshal(feature)
+}
@@ -0,0 +1,125 @@
+package geoip
+
+import "errors"
+
+// Levels of the places indexed by their geoname ID
+const (
+	geonameContinent = -2
+	geonameCountry   = -1
+	// Subdivisions use their index, starting at 0
+	geonameCity = 1 << 16
+)
+
+type geonameEntry struct {
+	ptr   int
+	level int
+}
+
+// BuildGeonameIndex walks the whole database and builds an index
+// from the GeonameID of every continent, country, subdivision and
+// city to a record containing it, which is required by
+// RecordForGeoname. Note that building the index takes a while and
+// uses a significant amount of memory for City databases, so it must
+// be requested explicitly. If the database is reloaded (e.g. by
+// URLStaleWhileRevalidate), the index is rebuilt automatically.
+func (g *GeoIP) BuildGeonameIndex() error {
+	return g.current().buildGeonameIndex()
+}
+
+// RecordForGeoname returns a Record for the place with the given
+// GeonameID, without requiring an IP address. The returned Record
+// contains the place and the ones enclosing it (e.g. a subdivision
+// includes the continent, the country and the larger subdivisions),
+// but no network specific information, like the coordinates, unless
+// the place is a city. If the index has not been built with
+// BuildGeonameIndex, the ID is not in the database or the place is
+// not decoded (see DecodeFields), it returns false.
+func (g *GeoIP) RecordForGeoname(id int) (*Record, bool) {
+	db := g.current()
+	db.mu.Lock()
+	entry, ok := db.geonames[id]
+	db.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	rec, err := g.recordAt(db, entry.ptr)
+	if err != nil {
+		return nil, false
+	}
+	// The record is decoded with the GeoIP options, which might not
+	// include the indexed place (e.g. DecodeFields or
+	// CodelessSubdivisions), so match it by ID rather than by level.
+	place := &Record{Continent: rec.Continent}
+	switch {
+	case entry.level == geonameCity:
+		if rec.City == nil || rec.City.GeonameID != id {
+			return nil, false
+		}
+		return rec, true
+	case entry.level == geonameContinent:
+		if rec.Continent == nil || rec.Continent.GeonameID != id {
+			return nil, false
+		}
+	case entry.level == geonameCountry:
+		if rec.Country == nil || rec.Country.GeonameID != id {
+			return nil, false
+		}
+		place.Country = rec.Country
+	default:
+		place.Country = rec.Country
+		found := false
+		for ii, v := range rec.Subdivisions {
+			if v != nil && v.GeonameID == id {
+				place.Subdivisions = rec.Subdivisions[:ii+1]
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	return place, true
+}
+
+func (db *database) hasGeonameIndex() bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.geonames != nil
+}
+
+func (db *database) buildGeonameIndex() error {
+	if db.hasGeonameIndex() {
+		return nil
+	}
+	opts := &options{fields: FieldContinent | FieldCountry | FieldSubdivisions | FieldCity, dropNames: true}
+	index := make(map[int]geonameEntry)
+	add := func(p *Place, ptr int, level int) {
+		if p == nil || p.GeonameID == 0 {
+			return
+		}
+		if _, ok := index[p.GeonameID]; ok {
+			return
+		}
+		index[p.GeonameID] = geonameEntry{ptr: ptr, level: level}
+	}
+	err := db.walkRecords(opts, "", func(ptr int, rec *Record) error {
+		add(rec.Continent, ptr, geonameContinent)
+		add(rec.Country, ptr, geonameCountry)
+		for ii, v := range rec.Subdivisions {
+			add(v, ptr, ii)
+		}
+		add(rec.City, ptr, geonameCity)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(index) == 0 {
+		return errors.New("database has no places with a geoname ID")
+	}
+	db.mu.Lock()
+	db.geonames = index
+	db.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,18 @@
+module github.com/rainycape/geoip
+
+go 1.23.0
+
+require (
+	github.com/ProtonMail/go-crypto v1.3.0
+	github.com/fsnotify/fsnotify v1.9.0
+	github.com/oschwald/geoip2-golang v1.9.0
+	github.com/oschwald/maxminddb-golang v1.12.0
+	golang.org/x/net v0.40.0
+	golang.org/x/text v0.25.0
+)
+
+require (
+	github.com/cloudflare/circl v1.6.1 // indirect
+	golang.org/x/crypto v0.38.0 // indirect
+	golang.org/x/sys v0.33.0 // indirect
+)
@@ -0,0 +1,50 @@
+package geoip
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// HostRecord contains a resolved address of a host and its
+// record. See GeoIP.LookupHost.
+type HostRecord struct {
+	// IP is the resolved address.
+	IP net.IP
+	// Record is the record for IP, or nil if the address
+	// is not in the database.
+	Record *Record
+}
+
+// LookupHost resolves the given hostname, using the resolver set with
+// HostResolver, and returns the records for its addresses, in the same
+// order returned by the resolver. Addresses which are not in the
+// database are returned with a nil Record. If host is an IP address,
+// it's looked up directly without resolving it.
+func (g *GeoIP) LookupHost(ctx context.Context, host string) ([]HostRecord, error) {
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		resolver := g.opts.resolver
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		addrs, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range addrs {
+			ips = append(ips, v.IP)
+		}
+	}
+	records := make([]HostRecord, len(ips))
+	for ii, ip := range ips {
+		rec, err := g.LookupIP(ip)
+		if err != nil && !errors.Is(err, errAddrNotFound) {
+			return nil, err
+		}
+		records[ii] = HostRecord{IP: ip, Record: rec}
+	}
+	return records, nil
+}
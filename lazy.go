@@ -0,0 +1,70 @@
+package geoip
+
+import (
+	"net"
+	"strings"
+	"sync"
+)
+
+// LazyGeoIP opens a database on its first use. See OpenLazy for
+// more information. LazyGeoIP implements Lookuper and is safe
+// for concurrent use.
+type LazyGeoIP struct {
+	source string
+	opts   []URLOpt
+	once   sync.Once
+	g      *GeoIP
+	err    error
+}
+
+// OpenLazy returns a LazyGeoIP which opens the database at source
+// the first time it's used, rather than immediately. This avoids
+// paying the cost of downloading and decoding the database in code
+// paths which never perform a lookup. If source is an HTTP(S) URL
+// the database is opened with OpenURL, otherwise it's assumed to be a
+// file and opened with Open, using the options set with URLDatabaseOpts.
+// The database is opened only once, even when it fails, and its error
+// is returned by every lookup. Use Warmup to open it in advance.
+func OpenLazy(source string, opts ...URLOpt) *LazyGeoIP {
+	return &LazyGeoIP{source: source, opts: opts}
+}
+
+// GeoIP opens the database if it hasn't been opened yet and
+// returns it, or the error found while opening it.
+func (l *LazyGeoIP) GeoIP() (*GeoIP, error) {
+	l.once.Do(func() {
+		if strings.HasPrefix(l.source, "http://") || strings.HasPrefix(l.source, "https://") {
+			l.g, l.err = OpenURL(l.source, l.opts...)
+		} else {
+			l.g, l.err = Open(l.source, newURLOptions(l.opts).DatabaseOpts...)
+		}
+	})
+	return l.g, l.err
+}
+
+// Warmup opens the database if it hasn't been opened yet,
+// returning the error found while opening it.
+func (l *LazyGeoIP) Warmup() error {
+	_, err := l.GeoIP()
+	return err
+}
+
+// Lookup works like GeoIP.Lookup, opening the database first
+// if needed.
+func (l *LazyGeoIP) Lookup(addr string) (*Record, error) {
+	g, err := l.GeoIP()
+	if err != nil {
+		return nil, err
+	}
+	return g.Lookup(addr)
+}
+
+// LookupIP works like GeoIP.LookupIP, opening the database first
+// if needed.
+func (l *LazyGeoIP) LookupIP(ip net.IP) (*Record, error) {
+	g, err := l.GeoIP()
+	if err != nil {
+		return nil, err
+	}
+	return g.LookupIP(ip)
+}
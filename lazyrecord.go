@@ -0,0 +1,117 @@
+package geoip
+
+import (
+	"math/bits"
+	"net"
+	"sync"
+)
+
+// LazyRecord holds the raw value of a record and decodes each
+// section of it (see Field) the first time it's accessed. This
+// reduces the allocations for callers which usually read only a
+// few fields. Fields with unexpected types are left empty, like
+// in LookupIPWarnings. LazyRecord is safe for concurrent use. See
+// GeoIP.LookupLazy.
+type LazyRecord struct {
+	val      interface{}
+	opts     options
+	mu       sync.Mutex
+	sections [8]*Record
+}
+
+// LookupLazy works like LookupIP, but it returns a *LazyRecord
+// which decodes the record on demand.
+func (g *GeoIP) LookupLazy(ip net.IP) (*LazyRecord, error) {
+	val, err := g.LookupIPValue(ip)
+	if err != nil {
+		return nil, err
+	}
+	opts := g.opts
+	opts.strict = false
+	return &LazyRecord{val: val, opts: opts}, nil
+}
+
+// section returns a Record with only the given section decoded.
+func (r *LazyRecord) section(f Field) *Record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	idx := bits.TrailingZeros(uint(f))
+	if rec := r.sections[idx]; rec != nil {
+		return rec
+	}
+	rec := new(Record)
+	if r.opts.decodes(f) {
+		opts := r.opts
+		opts.fields = f
+		if decoded, err := newRecord(r.val, &opts); err == nil {
+			rec = decoded
+		}
+	}
+	r.sections[idx] = rec
+	return rec
+}
+
+// Continent returns the continent of the record. See
+// Record.Continent.
+func (r *LazyRecord) Continent() *Place {
+	return r.section(FieldContinent).Continent
+}
+
+// Country returns the country of the record. See
+// Record.Country.
+func (r *LazyRecord) Country() *Place {
+	return r.section(FieldCountry).Country
+}
+
+// CountryCode works like Record.CountryCode.
+func (r *LazyRecord) CountryCode() string {
+	return r.section(FieldCountry).CountryCode()
+}
+
+// RegisteredCountry returns the registered country of the
+// record. See Record.RegisteredCountry.
+func (r *LazyRecord) RegisteredCountry() *Place {
+	return r.section(FieldCountry).RegisteredCountry
+}
+
+// RepresentedCountry returns the represented country of the
+// record. See Record.RepresentedCountry.
+func (r *LazyRecord) RepresentedCountry() *Place {
+	return r.section(FieldCountry).RepresentedCountry
+}
+
+// City returns the city of the record. See Record.City.
+func (r *LazyRecord) City() *Place {
+	return r.section(FieldCity).City
+}
+
+// Subdivisions returns the subdivisions of the record. See
+// Record.Subdivisions.
+func (r *LazyRecord) Subdivisions() []*Place {
+	return r.section(FieldSubdivisions).Subdivisions
+}
+
+// Coordinates returns the coordinates of the record and
+// whether they're known. See Record.HasCoordinates.
+func (r *LazyRecord) Coordinates() (LatLng, bool) {
+	rec := r.section(FieldLocation)
+	return LatLng{Lat: rec.Latitude, Lng: rec.Longitude}, rec.HasCoordinates()
+}
+
+// TimeZone returns the time zone of the record. See
+// Record.TimeZone.
+func (r *LazyRecord) TimeZone() string {
+	return r.section(FieldLocation).TimeZone
+}
+
+// PostalCode returns the postal code of the record. See
+// Record.PostalCode.
+func (r *LazyRecord) PostalCode() string {
+	return r.section(FieldPostal).PostalCode
+}
+
+// Record decodes the whole record, as returned by LookupIP.
+// Note that the result is not cached.
+func (r *LazyRecord) Record() (*Record, error) {
+	return newRecord(r.val, &r.opts)
+}
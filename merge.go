@@ -0,0 +1,95 @@
+package geoip
+
+import (
+	"reflect"
+)
+
+// MergeRecords combines the given records, usually returned by
+// different databases for the same IP address, into a new Record.
+// The priority function is called with the name of each Record
+// field (e.g. "Latitude" or "City") and must return the index into
+// records of the record which should provide that field. If the
+// chosen record is nil or the field is empty in it, the first record
+// with a non-empty value for the field is used instead. A nil priority
+// function or a negative index means first non-empty value wins.
+// Places are always taken whole from a single record, and so are
+// the coordinates: Latitude and Longitude come from the same record,
+// chosen using the priority for "Latitude" and preferring records
+// with both coordinates (see Record.HasCoordinates). Note that the
+// returned Record shares its Places with the records it was built
+// from.
+func MergeRecords(priority func(field string) int, records ...*Record) *Record {
+	merged, _ := mergeRecords(priority, records)
+	return merged
+}
+
+// mergeRecords implements MergeRecords, but also returns the index
+// of the record which provided each field of the merged one, or
+// -1 if no record provided it.
+func mergeRecords(priority func(field string) int, records []*Record) (*Record, []int) {
+	merged := new(Record)
+	dst := reflect.ValueOf(merged).Elem()
+	typ := dst.Type()
+	sources := make([]int, typ.NumField())
+	coords := coordinatesSource(priority, records)
+	for ii := range sources {
+		sources[ii] = -1
+		if typ.Field(ii).PkgPath != "" {
+			// unexported, handled below
+			continue
+		}
+		name := typ.Field(ii).Name
+		if name == "Latitude" || name == "Longitude" {
+			if coords >= 0 {
+				dst.Field(ii).Set(reflect.ValueOf(records[coords]).Elem().Field(ii))
+				sources[ii] = coords
+			}
+			continue
+		}
+		if priority != nil {
+			if p := priority(name); p >= 0 && p < len(records) && records[p] != nil {
+				if v := reflect.ValueOf(records[p]).Elem().Field(ii); !v.IsZero() {
+					dst.Field(ii).Set(v)
+					sources[ii] = p
+					continue
+				}
+			}
+		}
+		for jj, r := range records {
+			if r == nil {
+				continue
+			}
+			if v := reflect.ValueOf(r).Elem().Field(ii); !v.IsZero() {
+				dst.Field(ii).Set(v)
+				sources[ii] = jj
+				break
+			}
+		}
+	}
+	merged.coords = coords >= 0 && records[coords].coords
+	return merged, sources
+}
+
+// coordinatesSource returns the index of the record which provides
+// the coordinates when merging records, or -1 if none of them has
+// coordinates. Records with both coordinates in the database are
+// preferred over those with a partial location (e.g. only the
+// latitude).
+func coordinatesSource(priority func(field string) int, records []*Record) int {
+	for _, complete := range []bool{true, false} {
+		hasCoords := func(r *Record) bool {
+			return r != nil && (r.coords || (!complete && r.HasCoordinates()))
+		}
+		if priority != nil {
+			if p := priority("Latitude"); p >= 0 && p < len(records) && hasCoords(records[p]) {
+				return p
+			}
+		}
+		for ii, r := range records {
+			if hasCoords(r) {
+				return ii
+			}
+		}
+	}
+	return -1
+}
@@ -0,0 +1,54 @@
+package geoip
+
+import (
+	"errors"
+	"time"
+)
+
+// Metrics is the interface implemented by types which receive
+// events about the lookups performed by a GeoIP, usually to
+// export them to a monitoring system. See GeoIP.SetMetrics.
+type Metrics interface {
+	// IncLookup is called once for every lookup.
+	IncLookup()
+	// IncNotFound is called when the database has no record
+	// for the looked up address.
+	IncNotFound()
+	// IncError is called when the lookup fails for any other
+	// reason (e.g. an invalid address).
+	IncError()
+	// ObserveLatency is called with the time spent in
+	// every lookup.
+	ObserveLatency(d time.Duration)
+}
+
+type metricsValue struct {
+	m Metrics
+}
+
+// SetMetrics sets the Metrics which receive events about the
+// lookups performed by g, like LookupIP or LookupAddr. Use a nil
+// Metrics to disable them. When no Metrics is set, lookups don't
+// incur in any additional overhead.
+func (g *GeoIP) SetMetrics(m Metrics) {
+	g.metrics.Store(metricsValue{m})
+}
+
+func (g *GeoIP) loadMetrics() Metrics {
+	if v, ok := g.metrics.Load().(metricsValue); ok {
+		return v.m
+	}
+	return nil
+}
+
+func observeLookup(m Metrics, start time.Time, err *error) {
+	m.IncLookup()
+	if e := *err; e != nil {
+		if errors.Is(e, errAddrNotFound) {
+			m.IncNotFound()
+		} else {
+			m.IncError()
+		}
+	}
+	m.ObserveLatency(time.Since(start))
+}
@@ -0,0 +1,85 @@
+package geoip
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// OpenMmap works like Open, but rather than reading the database into
+// the Go heap, it maps the file into memory. This makes opening large
+// databases almost instantaneous and allows several processes using
+// the same file to share its pages in the page cache. Compressed
+// databases can't be mapped, use Open for them. Call GeoIP.Close to
+// release the mapping once the database is not used anymore. The file
+// should not be truncated nor modified in place while it's mapped
+// (replace it with a rename instead). On systems without mmap
+// support, the file is read into memory like Open does.
+func OpenMmap(filename string, opts ...Opt) (*GeoIP, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, release, err := mmapFile(f)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b {
+		release()
+		return nil, errors.New("compressed databases can't be memory mapped, use Open")
+	}
+	db, err := newDatabaseBytes(data)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	g := newGeoIP(db, opts)
+	g.setRelease(db, release)
+	g.source = &source{filename: filename, mmap: true}
+	if err := g.watch(filename); err != nil {
+		g.Close()
+		return nil, err
+	}
+	return g, nil
+}
+
+// reloadMmap implements ReloadFrom for databases opened with
+// OpenMmap, mapping f into memory. Compressed databases are read
+// into memory instead. The previous mapping is retired rather than
+// released, since lookups might still be using it.
+func (g *GeoIP) reloadMmap(f *os.File) error {
+	data, release, err := mmapFile(f)
+	if err != nil {
+		return err
+	}
+	if len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b {
+		release()
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return g.reloadData(f)
+	}
+	db, err := newDatabaseBytes(data)
+	if err != nil {
+		release()
+		return err
+	}
+	r := g.newReleaser(release)
+	db.releaser = r
+	// Hold g.mu, so Close can't release the previous
+	// mapping instead of this one
+	g.mu.Lock()
+	err = g.replace(db)
+	prev := g.releaser
+	if err == nil {
+		g.releaser = r
+	}
+	g.mu.Unlock()
+	if err != nil {
+		r.Release()
+		return err
+	}
+	prev.retire()
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !unix
+
+package geoip
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// mmapFile reads the whole file f into memory, since
+// mmap is not supported in this platform.
+func mmapFile(f *os.File) ([]byte, func() error, error) {
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return nil }, nil
+}
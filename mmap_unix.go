@@ -0,0 +1,27 @@
+//go:build unix
+
+package geoip
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// mmapFile maps the whole file f into memory, returning the mapped
+// data and the function which unmaps it.
+func mmapFile(f *os.File) ([]byte, func() error, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	size := fi.Size()
+	if size <= 0 || int64(int(size)) != size {
+		return nil, nil, errors.New("invalid database file size")
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return syscall.Munmap(data) }, nil
+}
@@ -0,0 +1,83 @@
+package geoip
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// Lookuper is the interface implemented by types which map IP
+// addresses to a Record. *GeoIP implements Lookuper, so packages
+// which depend on geoip can accept a Lookuper and use NewMock
+// in their tests rather than loading a database.
+type Lookuper interface {
+	Lookup(addr string) (*Record, error)
+	LookupIP(ip net.IP) (*Record, error)
+}
+
+type mockEntry struct {
+	prefix netip.Prefix
+	rec    *Record
+}
+
+type mock struct {
+	// Sorted from the most to the least specific
+	entries []mockEntry
+}
+
+// NewMock returns a Lookuper which serves the given records, keyed
+// either by their IP address (e.g. "17.0.0.1" or "2001:db8::1") or by
+// the network they cover in CIDR notation (e.g. "17.0.0.0/8"). When
+// several networks contain an address, the most specific one is used,
+// like in a real database. Invalid keys are ignored. Looking up an
+// address not covered by records returns an error, just like *GeoIP
+// does for unknown addresses.
+func NewMock(records map[string]*Record) Lookuper {
+	m := &mock{entries: make([]mockEntry, 0, len(records))}
+	for k, v := range records {
+		var prefix netip.Prefix
+		if strings.Contains(k, "/") {
+			p, err := netip.ParsePrefix(k)
+			if err != nil {
+				continue
+			}
+			prefix = p.Masked()
+		} else {
+			addr, err := netip.ParseAddr(k)
+			if err != nil {
+				continue
+			}
+			addr = addr.Unmap()
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		m.entries = append(m.entries, mockEntry{prefix: prefix, rec: v})
+	}
+	sort.Slice(m.entries, func(i, j int) bool {
+		return m.entries[i].prefix.Bits() > m.entries[j].prefix.Bits()
+	})
+	return m
+}
+
+func (m *mock) Lookup(addr string) (*Record, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not a valid IPv4 nor IPv6 address", addr)
+	}
+	return m.LookupIP(ip)
+}
+
+func (m *mock) LookupIP(ip net.IP) (*Record, error) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return nil, errInvalidIP
+	}
+	addr = addr.Unmap()
+	for _, v := range m.entries {
+		if v.prefix.Contains(addr) {
+			return v.rec, nil
+		}
+	}
+	return nil, &notFoundError{ip.String()}
+}
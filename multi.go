@@ -0,0 +1,130 @@
+package geoip
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+)
+
+// MultiGeoIP combines several databases (e.g. City, ASN and
+// Anonymous-IP) into a single one. Lookups query every database
+// and merge their records, using the non-empty value for each field
+// from the database with the most specific network (i.e. the longest
+// prefix) containing the address. Databases with equally specific
+// networks are used in the order they were added. Use NewMultiGeoIP
+// to initialize a MultiGeoIP.
+type MultiGeoIP struct {
+	names []string
+	dbs   []*GeoIP
+}
+
+// NewMultiGeoIP returns a new empty MultiGeoIP. Use Add to
+// add databases to it.
+func NewMultiGeoIP() *MultiGeoIP {
+	return &MultiGeoIP{}
+}
+
+// Add adds the database g with the given name, which is used to
+// identify it in LookupExplained, and returns m to allow chaining.
+// Databases added first take precedence over the ones with equally
+// specific networks. Note that Add must not be
+// called concurrently with lookups, so add all your databases before
+// sharing m with other goroutines.
+func (m *MultiGeoIP) Add(name string, g *GeoIP) *MultiGeoIP {
+	m.names = append(m.names, name)
+	m.dbs = append(m.dbs, g)
+	return m
+}
+
+// Lookup works like GeoIP.Lookup, but queries all the databases
+// in m, merging their results.
+func (m *MultiGeoIP) Lookup(addr string) (*Record, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		var err error
+		if ip, _, err = net.ParseCIDR(addr); err != nil {
+			return nil, err
+		}
+	}
+	return m.LookupIP(ip)
+}
+
+// LookupIP works like GeoIP.LookupIP, but queries all the
+// databases in m, merging their results.
+func (m *MultiGeoIP) LookupIP(ip net.IP) (*Record, error) {
+	rec, _, err := m.lookup(ip)
+	return rec, err
+}
+
+// LookupExplained works like LookupIP, but it also returns a map
+// from the names of the non-empty fields in the returned Record
+// (e.g. "Country") to the name of the database which provided them.
+// This is useful for finding out why a merged record looks the way
+// it does.
+func (m *MultiGeoIP) LookupExplained(ip net.IP) (*Record, map[string]string, error) {
+	rec, sources, err := m.lookup(ip)
+	if err != nil {
+		return nil, nil, err
+	}
+	explained := make(map[string]string)
+	typ := reflect.TypeOf(rec).Elem()
+	for ii, v := range sources {
+		if v >= 0 {
+			explained[typ.Field(ii).Name] = m.names[v]
+		}
+	}
+	return rec, explained, nil
+}
+
+func (m *MultiGeoIP) lookup(ip net.IP) (*Record, []int, error) {
+	var indexes []int
+	var records []*Record
+	var prefixLens []int
+	for ii, g := range m.dbs {
+		if ip.To4() == nil && g.IPVersion() == 4 {
+			// IPv4 only database, can't contain ip
+			continue
+		}
+		res, err := g.lookupFull(ip)
+		if err != nil {
+			if errors.Is(err, errAddrNotFound) {
+				continue
+			}
+			return nil, nil, fmt.Errorf("error looking up %s in %s: %w", ip, m.names[ii], err)
+		}
+		indexes = append(indexes, ii)
+		records = append(records, res.Record)
+		prefixLens = append(prefixLens, res.PrefixLen)
+	}
+	if len(records) == 0 {
+		return nil, nil, &notFoundError{ip.String()}
+	}
+	order := specificityOrder(prefixLens)
+	sorted := make([]*Record, len(records))
+	for ii, v := range order {
+		sorted[ii] = records[v]
+	}
+	rec, sources := mergeRecords(nil, sorted)
+	for ii, v := range sources {
+		if v >= 0 {
+			sources[ii] = indexes[order[v]]
+		}
+	}
+	return rec, sources, nil
+}
+
+// specificityOrder returns the indexes of prefixLens sorted from
+// the most to the least specific network, keeping the original
+// order for equally specific ones.
+func specificityOrder(prefixLens []int) []int {
+	order := make([]int, len(prefixLens))
+	for ii := range order {
+		order[ii] = ii
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return prefixLens[order[i]] > prefixLens[order[j]]
+	})
+	return order
+}
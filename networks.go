@@ -0,0 +1,467 @@
+package geoip
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// walk traverses the whole search tree, calling fn for every network
+// which has a record associated with it, along with the record's
+// pointer. Networks in the IPv4 subtree of an IPv6 database are reported
+// as IPv4 networks and the aliases of the IPv4 subtree (e.g.
+// ::ffff:0:0/96) are skipped, so every network is reported only once.
+// If fn returns an error, the traversal stops and the error is returned.
+func (db *database) walk(fn func(network *net.IPNet, ptr int) error) error {
+	if db.closed {
+		return ErrClosed
+	}
+	size := 16
+	if db.ipVersion == 4 {
+		size = 4
+	}
+	return db.walkNode(0, make([]byte, size), 0, fn)
+}
+
+func (db *database) walkNode(node int, ip []byte, depth int, fn func(*net.IPNet, int) error) error {
+	if depth >= len(ip)*8 {
+		return errInvalidDatabase
+	}
+	for _, right := range []bool{false, true} {
+		next := db.decodeNode(node, right)
+		if next == db.nodeCount {
+			// Empty
+			continue
+		}
+		cur := make([]byte, len(ip))
+		copy(cur, ip)
+		if right {
+			cur[depth/8] |= 0x80 >> uint(depth%8)
+		}
+		if next > db.nodeCount {
+			if err := fn(db.walkNetwork(cur, depth+1), next); err != nil {
+				return err
+			}
+			continue
+		}
+		if db.isIPv4Alias(next, cur, depth+1) {
+			continue
+		}
+		if err := db.walkNode(next, cur, depth+1, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isIPv4Alias returns true iff node is the start of the IPv4 subtree but
+// it was reached from a path different than ::/96.
+func (db *database) isIPv4Alias(node int, ip []byte, depth int) bool {
+	if db.ipv4Start == 0 || node != db.ipv4Start || len(ip) != net.IPv6len {
+		return false
+	}
+	if depth != 96 {
+		return true
+	}
+	for _, b := range ip[:12] {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (db *database) walkNetwork(ip []byte, bits int) *net.IPNet {
+	if len(ip) == net.IPv6len && db.ipv4Start > 0 && bits >= 96 {
+		isV4 := true
+		for _, b := range ip[:12] {
+			if b != 0 {
+				isV4 = false
+				break
+			}
+		}
+		if isV4 {
+			return &net.IPNet{
+				IP:   net.IP(ip[12:]),
+				Mask: net.CIDRMask(bits-96, 32),
+			}
+		}
+	}
+	return &net.IPNet{
+		IP:   net.IP(ip),
+		Mask: net.CIDRMask(bits, len(ip)*8),
+	}
+}
+
+// Networks walks the whole database, calling fn with every network
+// which has a record associated with it, in address order. Records
+// are decoded with the options the database was opened with (see Opt),
+// so e.g. DecodeFields can be used to make the walk faster. Networks
+// in the IPv4 subtree of IPv6 databases are reported as IPv4 prefixes
+// and only once, even if the database aliases them (e.g. at
+// ::ffff:0:0/96 or 2002::/16). If fn returns an error, the walk stops
+// and the error is returned.
+func (g *GeoIP) Networks(fn func(network netip.Prefix, rec *Record) error) error {
+	db := g.current()
+	return db.walk(g.networkRecords(db, fn))
+}
+
+// NetworksWithin works like Networks, but only reports the networks
+// contained in the given prefix (e.g. 17.0.0.0/8), walking only the
+// matching part of the search tree. If the whole prefix is contained
+// in a larger network (e.g. the database has a single record for
+// 17.0.0.0/8 and prefix is 17.1.0.0/16), the larger network is reported.
+// IPv4 prefixes are supported for both IPv4 and IPv6 databases, while
+// IPv6 prefixes return an error for IPv4 databases.
+func (g *GeoIP) NetworksWithin(prefix netip.Prefix, fn func(network netip.Prefix, rec *Record) error) error {
+	if !prefix.IsValid() {
+		return errInvalidIP
+	}
+	prefix = prefix.Masked()
+	if addr := prefix.Addr(); addr.Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(addr.Unmap(), prefix.Bits()-96)
+	}
+	db := g.current()
+	if db.closed {
+		return ErrClosed
+	}
+	if prefix.Addr().Is4() && db.ipVersion == 6 && db.ipv4Start == 0 {
+		// No IPv4 subtree, IPv4 addresses are looked up
+		// as IPv4-mapped IPv6 ones
+		prefix = netip.PrefixFrom(netip.AddrFrom16(prefix.Addr().As16()), prefix.Bits()+96)
+	}
+	var ip []byte
+	node := 0
+	if prefix.Addr().Is4() {
+		data := prefix.Addr().As4()
+		ip = data[:]
+		node = db.ipv4Start
+	} else {
+		if db.ipVersion == 4 {
+			return fmt.Errorf("can't walk IPv6 network %s, database is IPv4", prefix)
+		}
+		data := prefix.Addr().As16()
+		ip = data[:]
+	}
+	walkFn := g.networkRecords(db, fn)
+	for depth := 0; depth < prefix.Bits(); depth++ {
+		next := db.decodeNode(node, ip[depth/8]&(0x80>>uint(depth%8)) != 0)
+		if next == db.nodeCount {
+			// Empty
+			return nil
+		}
+		if next > db.nodeCount {
+			// prefix is contained in this network
+			cur := net.IP(ip).Mask(net.CIDRMask(depth+1, len(ip)*8))
+			return walkFn(db.walkNetwork(cur, depth+1), next)
+		}
+		node = next
+	}
+	return db.walkNode(node, ip, prefix.Bits(), walkFn)
+}
+
+// networkRecords returns a function for walking db which
+// decodes the record for every network and calls fn with it.
+func (g *GeoIP) networkRecords(db *database, fn func(netip.Prefix, *Record) error) func(*net.IPNet, int) error {
+	return func(network *net.IPNet, ptr int) error {
+		rec, err := g.recordAt(db, ptr)
+		if err != nil {
+			return err
+		}
+		addr, _ := netip.AddrFromSlice(network.IP)
+		bits, _ := network.Mask.Size()
+		return fn(netip.PrefixFrom(addr, bits), rec)
+	}
+}
+
+// CoverageByCountry walks the whole database and returns the number of
+// networks associated with each country, keyed by its ISO 3166-1 2 letter
+// code. Networks without a country are not counted. Comparing the results
+// for different versions of a database allows spotting countries which
+// lost coverage.
+func (g *GeoIP) CoverageByCountry() (map[string]int, error) {
+	db := g.current()
+	coverage := make(map[string]int)
+	codes := make(map[int]string)
+	err := db.walk(func(_ *net.IPNet, ptr int) error {
+		code, ok := codes[ptr]
+		if !ok {
+			var err error
+			if code, err = db.countryCodeAt(ptr); err != nil {
+				return err
+			}
+			codes[ptr] = code
+		}
+		if code != "" {
+			coverage[code]++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return coverage, nil
+}
+
+// CountryBounds walks the whole database and returns the bounding box
+// of the coordinates of the records associated with the country with
+// the given ISO 3166-1 2 letter code. Records without coordinates (see
+// Record.HasCoordinates) are ignored. This is useful for validating that
+// a location is not wildly outside the country it claims to be in.
+// Note that the bounding box of countries crossing the antimeridian
+// spans almost all longitudes.
+func (g *GeoIP) CountryBounds(iso string) (minLat, minLng, maxLat, maxLng float64, err error) {
+	db := g.current()
+	iso = strings.ToUpper(iso)
+	opts := &options{fields: FieldLocation, zeroCoordsMissing: g.opts.zeroCoordsMissing}
+	found := false
+	err = db.walkRecords(opts, iso, func(_ int, rec *Record) error {
+		if !rec.HasCoordinates() {
+			return nil
+		}
+		if !found {
+			minLat, maxLat = rec.Latitude, rec.Latitude
+			minLng, maxLng = rec.Longitude, rec.Longitude
+			found = true
+			return nil
+		}
+		minLat = math.Min(minLat, rec.Latitude)
+		maxLat = math.Max(maxLat, rec.Latitude)
+		minLng = math.Min(minLng, rec.Longitude)
+		maxLng = math.Max(maxLng, rec.Longitude)
+		return nil
+	})
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	if !found {
+		return 0, 0, 0, 0, fmt.Errorf("no records with coordinates found for country %q", iso)
+	}
+	return minLat, minLng, maxLat, maxLng, nil
+}
+
+// SubdivisionsOf walks the whole database and returns the distinct
+// subdivisions of the country with the given ISO 3166-1 2 letter code,
+// sorted by their code. Only the largest subdivision of each record
+// (e.g. states in the US) is considered. Results are cached per
+// country, so only the first call for each country walks the database.
+// The returned Places are copies and might be modified freely.
+func (g *GeoIP) SubdivisionsOf(countryISO string) ([]*Place, error) {
+	db := g.current()
+	countryISO = strings.ToUpper(countryISO)
+	subdivisions, err := db.subdivisionsOf(countryISO)
+	if err != nil {
+		return nil, err
+	}
+	places := make([]*Place, len(subdivisions))
+	for ii, v := range subdivisions {
+		places[ii] = v.Clone()
+	}
+	return places, nil
+}
+
+func (db *database) subdivisionsOf(countryISO string) ([]*Place, error) {
+	db.mu.Lock()
+	places, ok := db.subdivisions[countryISO]
+	db.mu.Unlock()
+	if ok {
+		return places, nil
+	}
+	opts := &options{fields: FieldSubdivisions}
+	byCode := make(map[string]*Place)
+	err := db.walkRecords(opts, countryISO, func(_ int, rec *Record) error {
+		if sub := rec.SubdivisionAt(0); sub != nil && sub.Code != "" && byCode[sub.Code] == nil {
+			byCode[sub.Code] = sub
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	places = make([]*Place, 0, len(byCode))
+	for _, v := range byCode {
+		places = append(places, v)
+	}
+	sort.Slice(places, func(i, j int) bool {
+		return places[i].Code < places[j].Code
+	})
+	// Only cache valid countries, so callers can't grow
+	// the cache without bounds.
+	if _, ok := countryNumericCodes[countryISO]; ok {
+		db.mu.Lock()
+		if db.subdivisions == nil {
+			db.subdivisions = make(map[string][]*Place)
+		}
+		db.subdivisions[countryISO] = places
+		db.mu.Unlock()
+	}
+	return places, nil
+}
+
+// walkRecords walks db, calling fn once for every distinct record in
+// it, decoded with opts. If countryISO is not empty, only the records
+// for that country are decoded, while the rest are skipped.
+func (db *database) walkRecords(opts *options, countryISO string, fn func(ptr int, rec *Record) error) error {
+	seen := make(map[int]bool)
+	return db.walk(func(_ *net.IPNet, ptr int) error {
+		if seen[ptr] {
+			return nil
+		}
+		seen[ptr] = true
+		if countryISO != "" {
+			code, err := db.countryCodeAt(ptr)
+			if err != nil || code != countryISO {
+				return err
+			}
+		}
+		val, err := db.recordValue(ptr, opts)
+		if err != nil {
+			return err
+		}
+		rec, err := newRecord(val, opts)
+		if err != nil {
+			return err
+		}
+		return fn(ptr, rec)
+	})
+}
+
+// LatLng represents a pair of coordinates.
+type LatLng struct {
+	Lat float64
+	Lng float64
+}
+
+var errStopWalk = errors.New("stop walk")
+
+// CoordinatesForPlace walks the database looking for a record in the
+// country with the given ISO 3166-1 2 letter code, with a subdivision
+// with the given code at any level and a city with the given name in
+// any language, compared case insensitively. Empty subdivisionCode or
+// cityName match any subdivision or city. It returns the coordinates
+// of the first matching record with coordinates and true, or false if
+// there's none. Note that the returned coordinates are approximate,
+// since they're associated with the networks rather than with the
+// place itself.
+func (g *GeoIP) CoordinatesForPlace(countryISO, subdivisionCode, cityName string) (LatLng, bool, error) {
+	db := g.current()
+	countryISO = strings.ToUpper(countryISO)
+	opts := &options{fields: FieldSubdivisions | FieldCity | FieldLocation, zeroCoordsMissing: g.opts.zeroCoordsMissing}
+	var coords LatLng
+	found := false
+	err := db.walkRecords(opts, countryISO, func(_ int, rec *Record) error {
+		if !rec.HasCoordinates() || !matchesSubdivision(rec, subdivisionCode) || !matchesCity(rec, cityName) {
+			return nil
+		}
+		coords = LatLng{Lat: rec.Latitude, Lng: rec.Longitude}
+		found = true
+		return errStopWalk
+	})
+	if err != nil && err != errStopWalk {
+		return LatLng{}, false, err
+	}
+	return coords, found, nil
+}
+
+func matchesSubdivision(rec *Record, code string) bool {
+	if code == "" {
+		return true
+	}
+	for _, v := range rec.Subdivisions {
+		if strings.EqualFold(v.Code, code) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesCity(rec *Record, name string) bool {
+	if name == "" {
+		return true
+	}
+	if rec.City == nil {
+		return false
+	}
+	for _, v := range rec.City.Name {
+		if strings.EqualFold(v, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// ChangedNetworks compares the databases old and new, returning the
+// networks whose records differ between them, including the ones
+// which are present only in one of them. Every network from both
+// databases is compared against the record returned by the other one
+// for its first address, so when the networks have been split or
+// merged the returned networks might come from either database.
+func ChangedNetworks(old, new *GeoIP) ([]*net.IPNet, error) {
+	var changed []*net.IPNet
+	seen := make(map[string]bool)
+	compare := func(a, b *database) error {
+		values := newValueCache(a)
+		others := newValueCache(b)
+		return a.walk(func(network *net.IPNet, ptr int) error {
+			val, err := values.value(ptr)
+			if err != nil {
+				return err
+			}
+			equal := false
+			if b.ipVersion == 4 && network.IP.To4() == nil {
+				// Not present in b
+			} else if p, err := b.lookupIPPointer(network.IP); err == nil {
+				other, err := others.value(p)
+				if err != nil {
+					return err
+				}
+				equal = reflect.DeepEqual(val, other)
+			} else if !errors.Is(err, errAddrNotFound) {
+				return err
+			}
+			if !equal {
+				if key := network.String(); !seen[key] {
+					seen[key] = true
+					changed = append(changed, network)
+				}
+			}
+			return nil
+		})
+	}
+	oldDB, newDB := old.current(), new.current()
+	if err := compare(newDB, oldDB); err != nil {
+		return nil, err
+	}
+	if err := compare(oldDB, newDB); err != nil {
+		return nil, err
+	}
+	return changed, nil
+}
+
+// valueCache decodes the values from a database, caching
+// them by their pointer.
+type valueCache struct {
+	db     *database
+	values map[int]interface{}
+}
+
+func newValueCache(db *database) *valueCache {
+	return &valueCache{db: db, values: make(map[int]interface{})}
+}
+
+func (c *valueCache) value(ptr int) (interface{}, error) {
+	if v, ok := c.values[ptr]; ok {
+		return v, nil
+	}
+	v, err := c.db.lookupResult(ptr)
+	if err != nil {
+		return nil, err
+	}
+	c.values[ptr] = v
+	return v, nil
+}
@@ -0,0 +1,207 @@
+package geoip
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// Field is a bitmask which indicates the sections of a Record
+// that should be decoded. See the Field* constants and DecodeFields
+// for more information.
+type Field uint
+
+const (
+	// FieldContinent decodes Record.Continent.
+	FieldContinent Field = 1 << iota
+	// FieldCountry decodes Record.Country, Record.RegisteredCountry
+	// and Record.RepresentedCountry.
+	FieldCountry
+	// FieldCity decodes Record.City.
+	FieldCity
+	// FieldSubdivisions decodes Record.Subdivisions.
+	FieldSubdivisions
+	// FieldLocation decodes Record.Latitude, Record.Longitude,
+	// Record.MetroCode and Record.TimeZone.
+	FieldLocation
+	// FieldPostal decodes Record.PostalCode.
+	FieldPostal
+	// FieldTraits decodes the traits of the network in Record
+	// (e.g. IsAnonymousProxy, UserType or ConnectionType).
+	FieldTraits
+	// FieldASN decodes Record.ASN, Record.ASOrganization, Record.ISP
+	// and Record.Organization.
+	FieldASN
+	// FieldAll decodes all the available fields. This is the
+	// default.
+	FieldAll Field = 0
+)
+
+// SubdivisionCodes indicates how subdivisions without a code
+// are handled. See CodelessSubdivisions for more information.
+type SubdivisionCodes int
+
+const (
+	// SubdivisionCodesKeep returns subdivisions without a code
+	// with an empty Place.Code. This is the default.
+	SubdivisionCodesKeep SubdivisionCodes = iota
+	// SubdivisionCodesSkip omits subdivisions without a code
+	// from Record.Subdivisions.
+	SubdivisionCodesSkip
+	// SubdivisionCodesGeonameID uses the GeonameID of subdivisions
+	// without a code as their Place.Code (e.g. "6269131"). Subdivisions
+	// without neither a code nor a GeonameID are omitted.
+	SubdivisionCodesGeonameID
+)
+
+type options struct {
+	fields            Field
+	errorLog          *log.Logger
+	roundCoords       bool
+	coordPrecision    int
+	strict            bool
+	zeroCoordsMissing bool
+	cacheSize         int
+	subdivisionCodes  SubdivisionCodes
+	dropNames         bool
+	lookupTimeout     time.Duration
+	resolver          *net.Resolver
+	watchFile         bool
+	watchFunc         func(error)
+	progress          func(read, total int64)
+}
+
+func (o *options) decodes(f Field) bool {
+	return o.fields == FieldAll || o.fields&f != 0
+}
+
+// Opt is a function type which allows setting options for
+// a GeoIP when opening it. See New, Open and the functions
+// returning an Opt for more information.
+type Opt func(*options)
+
+// DecodeFields sets the sections that will be decoded into a
+// Record by each lookup, as a bitmask of the Field* constants (e.g.
+// FieldCountry|FieldLocation). Fields not included in the bitmask are
+// left empty and their data is skipped without decoding it, making
+// lookups faster and reducing the allocations they require (e.g. a
+// lookup with FieldCountry only allocates the country and its names).
+// A zero value (FieldAll) decodes every field.
+func DecodeFields(fields Field) Opt {
+	return func(opts *options) {
+		opts.fields = fields
+	}
+}
+
+// ErrorLog sets the logger used for reporting errors and warnings
+// which can't be returned to the caller, like a database being
+// garbage collected without releasing its resources. If no logger
+// is set, the standard logger from the log package is used.
+func ErrorLog(l *log.Logger) Opt {
+	return func(opts *options) {
+		opts.errorLog = l
+	}
+}
+
+// CoordinatePrecision rounds the Latitude and Longitude of every Record
+// to the given number of decimal places (e.g. 1 decimal place is roughly
+// 11km). This reduces the accuracy of the stored locations for privacy
+// reasons and makes records easier to deduplicate. A negative value
+// disables rounding, which is the default.
+func CoordinatePrecision(decimals int) Opt {
+	return func(opts *options) {
+		opts.roundCoords = decimals >= 0
+		opts.coordPrecision = decimals
+	}
+}
+
+// StrictDecoding makes lookups fail with a *DecodeError when some
+// field in the record has an unexpected type. By default, those
+// fields are left empty and the rest of the record is returned. See
+// also GeoIP.LookupIPWarnings.
+func StrictDecoding() Opt {
+	return func(opts *options) {
+		opts.strict = true
+	}
+}
+
+// TreatZeroCoordsAsMissing makes Record.HasCoordinates return false
+// for records located exactly at (0, 0), which databases sometimes
+// use as a placeholder for unknown coordinates. Since no real network
+// is located in the middle of the ocean, this heuristic is usually
+// safe. By default, coordinates are considered known whenever the
+// database includes them.
+func TreatZeroCoordsAsMissing(treat bool) Opt {
+	return func(opts *options) {
+		opts.zeroCoordsMissing = treat
+	}
+}
+
+// LookupCache enables an LRU cache of up to size decoded records,
+// which makes repeated lookups of the same networks faster. Records
+// are cached by their location in the database, so all the addresses
+// sharing a record share a cache entry. Cached records are copied
+// before returning them, so callers might modify them freely. See
+// GeoIP.LookupCacheStats and GeoIP.ClearLookupCache. The cache is
+// disabled by default.
+func LookupCache(size int) Opt {
+	return func(opts *options) {
+		opts.cacheSize = size
+	}
+}
+
+// CodelessSubdivisions sets how subdivisions without a code, which
+// some databases include for unofficial regions, are handled. By
+// default, they're kept with an empty code (SubdivisionCodesKeep). See
+// SubdivisionCodes for the available modes.
+func CodelessSubdivisions(mode SubdivisionCodes) Opt {
+	return func(opts *options) {
+		opts.subdivisionCodes = mode
+	}
+}
+
+// DropNames leaves the Name of every Place nil, rather than decoding
+// the translated names. This reduces the allocations per lookup and
+// the memory used by the returned records, which is useful when only
+// codes are needed (e.g. for routing by country). Name methods are
+// safe to call on a nil Name.
+func DropNames() Opt {
+	return func(opts *options) {
+		opts.dropNames = true
+	}
+}
+
+// LookupTimeout makes LookupIP and LookupAddr fail with an error
+// wrapping os.ErrDeadlineExceeded when a lookup takes longer than d.
+// This protects callers from lookups stalled by slow storage (e.g.
+// page faults on a database mapped from a network filesystem). Note
+// that the stalled lookup keeps running in the background until it
+// finishes, and the database resources (e.g. the mapping of a database
+// opened with OpenMmap) aren't released until then, even if the GeoIP
+// is closed. Since it requires running every lookup in its own
+// goroutine, it makes lookups slower. By default, there's no timeout.
+func LookupTimeout(d time.Duration) Opt {
+	return func(opts *options) {
+		opts.lookupTimeout = d
+	}
+}
+
+// ReadProgress sets a function which NewSized calls while reading
+// the database, with the number of bytes read so far and the total
+// size passed to NewSized (<= 0 if it's unknown). This allows e.g.
+// displaying a progress bar while loading a database streamed from
+// the network. Other functions ignore this option.
+func ReadProgress(fn func(read, total int64)) Opt {
+	return func(opts *options) {
+		opts.progress = fn
+	}
+}
+
+// HostResolver sets the *net.Resolver used by LookupHost for
+// resolving hostnames. This allows e.g. using a specific DNS
+// server. By default, net.DefaultResolver is used.
+func HostResolver(r *net.Resolver) Opt {
+	return func(opts *options) {
+		opts.resolver = r
+	}
+}
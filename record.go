@@ -2,25 +2,149 @@ package geoip
 
 import (
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/net/publicsuffix"
 )
 
 var (
 	codes = []string{"iso_code", "code"}
+	// languageVariants maps base languages to the regional
+	// variant used by MaxMind for their names.
+	languageVariants = map[string]string{
+		"en": "en",
+		"pt": "pt-BR",
+		"zh": "zh-CN",
+	}
+	defaultLanguages atomic.Pointer[[]string]
 )
 
+// SetDefaultLanguages sets the languages used, in order of
+// preference, when no language is explicitly given. The String
+// methods of Name, Place and Record return the names in the first
+// of them which is available, and so do the fallbacks of
+// Record.LocalizedNames and GeoIP.Description. English is always used
+// as the last fallback, so without default languages names are
+// returned in English. Record.Flat and Record.GeoJSON always return
+// the English names. It's safe to call it concurrently with lookups,
+// but it's intended to be called once while initializing the program,
+// since changing it affects every name returned afterwards.
+func SetDefaultLanguages(langs ...string) {
+	langs = append([]string(nil), langs...)
+	defaultLanguages.Store(&langs)
+}
+
 // Name represents a name with multiple localized names.
 type Name map[string]string
 
+// String returns the name in the default languages (see
+// SetDefaultLanguages), falling back to English.
 func (n Name) String() string {
+	return n.defaultName()
+}
+
+// defaultName returns the name in the default languages (see
+// SetDefaultLanguages), falling back to English.
+func (n Name) defaultName() string {
+	if langs := defaultLanguages.Load(); langs != nil {
+		for _, lang := range *langs {
+			if key := n.localizedKey(lang); key != "" {
+				return n[key]
+			}
+		}
+	}
 	return n["en"]
 }
 
 // LocalizedName returns the name in the given language, or
-// the empty string if the name lacks that translation.
+// the empty string if the name lacks that translation. Use
+// String to get the name in the default languages. See also
+// LocalizedNameFallback.
 func (n Name) LocalizedName(lang string) string {
 	return n[lang]
 }
 
+// LocalizedNameFallback works like LocalizedName, but when there's
+// no exact match for lang, regional variants fall back to their base
+// language (e.g. de-AT to de) and base languages fall back to the
+// variant used by MaxMind (en to en, pt to pt-BR and zh to zh-CN).
+// Traditional Chinese (e.g. zh-TW, zh-HK or zh-Hant) never falls back
+// to the Simplified Chinese names.
+func (n Name) LocalizedNameFallback(lang string) string {
+	return n[n.localizedKey(lang)]
+}
+
+// localizedKey returns the key of the translation used by
+// LocalizedNameFallback for lang, or the empty string if there's none.
+func (n Name) localizedKey(lang string) string {
+	if s := n[lang]; s != "" {
+		return lang
+	}
+	if traditionalChinese(lang) {
+		return ""
+	}
+	if p := strings.IndexAny(lang, "-_"); p > 0 {
+		lang = lang[:p]
+		if s := n[lang]; s != "" {
+			return lang
+		}
+	}
+	if v, ok := languageVariants[lang]; ok && n[v] != "" {
+		return v
+	}
+	return ""
+}
+
+// traditionalChinese returns true iff lang is a Chinese
+// variant written with Traditional characters, which can't
+// fall back to the Simplified Chinese zh-CN names.
+func traditionalChinese(lang string) bool {
+	parts := strings.FieldsFunc(strings.ToLower(lang), func(r rune) bool {
+		return r == '-' || r == '_'
+	})
+	if len(parts) < 2 || parts[0] != "zh" {
+		return false
+	}
+	for _, v := range parts[1:] {
+		switch v {
+		case "hant", "tw", "hk", "mo":
+			return true
+		}
+	}
+	return false
+}
+
+// only returns a new Name containing only the translations
+// which LocalizedNameFallback would return for langs, plus English.
+func (n Name) only(langs []string) Name {
+	if n == nil {
+		return nil
+	}
+	filtered := make(Name, len(langs)+1)
+	if s, ok := n["en"]; ok {
+		filtered["en"] = s
+	}
+	for _, lang := range langs {
+		if key := n.localizedKey(lang); key != "" {
+			filtered[key] = n[key]
+		}
+	}
+	return filtered
+}
+
+// localizedNameOrEnglish returns the name in the given
+// language, falling back to the default languages and then
+// to English.
+func (n Name) localizedNameOrEnglish(lang string) string {
+	if s := n.LocalizedNameFallback(lang); s != "" {
+		return s
+	}
+	return n.defaultName()
+}
+
 // Localizations returns the available localizations for
 // this name.
 func (n Name) Localizations() []string {
@@ -34,7 +158,7 @@ func (n Name) Localizations() []string {
 // Place represents a place with a Code, a GeonameID
 // (see http://www.geonames.org for more information), and a Name.
 // Code and GeonameID might be empty, but Name will always have at
-// least a value.
+// least a value, unless the database was opened with DropNames.
 type Place struct {
 	// Code is the given code for the place. For continents, this
 	// value is one of AF (Africa), AS (Asia), EU (Europe), OC (Oceania),
@@ -46,12 +170,57 @@ type Place struct {
 	GeonameID int
 	// Name is the place name, usually with several translations.
 	Name Name
+	// Confidence is MaxMind's confidence, from 1 to 100, that the
+	// place is correct. It's only available for cities, countries
+	// and subdivisions in GeoIP2 Enterprise databases, being 0
+	// otherwise. MaxMind recommends ignoring places with a low
+	// confidence when making decisions based on them.
+	Confidence int
+	// IsInEuropeanUnion is true iff the place is a country which
+	// is a member state of the European Union. It's only set for
+	// countries, and only by databases including it.
+	IsInEuropeanUnion bool
 }
 
+// String returns the name of the place, like Name.String.
 func (p *Place) String() string {
 	return p.Name.String()
 }
 
+// Clone returns a deep copy of the place.
+func (p *Place) Clone() *Place {
+	if p == nil {
+		return nil
+	}
+	c := *p
+	if p.Name != nil {
+		c.Name = make(Name, len(p.Name))
+		for k, v := range p.Name {
+			c.Name[k] = v
+		}
+	}
+	return &c
+}
+
+// ConnectionType indicates the kind of connection used by
+// an IP address, as stored by GeoIP2-Connection-Type and
+// GeoIP2 Enterprise databases.
+type ConnectionType string
+
+const (
+	// ConnectionTypeCableDSL is used for cable and DSL connections.
+	ConnectionTypeCableDSL ConnectionType = "Cable/DSL"
+	// ConnectionTypeCellular is used for mobile networks.
+	ConnectionTypeCellular ConnectionType = "Cellular"
+	// ConnectionTypeCorporate is used for corporate networks
+	// and other dedicated connections.
+	ConnectionTypeCorporate ConnectionType = "Corporate"
+	// ConnectionTypeDialup is used for dialup connections.
+	ConnectionTypeDialup ConnectionType = "Dialup"
+	// ConnectionTypeSatellite is used for satellite connections.
+	ConnectionTypeSatellite ConnectionType = "Satellite"
+)
+
 // Record hold the information returned for a given
 // IP address. See the comments on each field for more
 // information.
@@ -81,12 +250,12 @@ type Record struct {
 	// them will vary depending on the country.
 	Subdivisions []*Place
 	// Latitude of the location associated with the record.
-	// Note that a 0 Latitude and a 0 Longitude means the
-	// coordinates are not known.
+	// Use HasCoordinates to check if the coordinates are
+	// known.
 	Latitude float64
 	// Longitude of the location associated with the record.
-	// Note that a 0 Latitude and a 0 Longitude means the
-	// coordinates are not known.
+	// Use HasCoordinates to check if the coordinates are
+	// known.
 	Longitude float64
 	// MetroCode contains the metro code associated with the
 	// record. These are only available in the US
@@ -94,6 +263,10 @@ type Record struct {
 	// PostalCode associated with the record. These are available in
 	// AU, CA, FR, DE, IT, ES, CH, UK and US.
 	PostalCode string
+	// PostalConfidence is MaxMind's confidence, from 1 to 100, that
+	// PostalCode is correct. Like Place.Confidence, it's only available
+	// in GeoIP2 Enterprise databases, being 0 otherwise.
+	PostalConfidence int
 	// TimeZone associated with the record, in IANA format (e.g.
 	// America/New_York). See http://www.iana.org/time-zones.
 	TimeZone string
@@ -105,6 +278,124 @@ type Record struct {
 	// service to multiple countries. These IPs might be
 	// in high risk countries.
 	IsSatelliteProvider bool
+	// IsAnonymous is true iff the IP address belongs to any
+	// kind of anonymizer (see the other IsAnonymous* fields).
+	// This and the following flags are only available in
+	// GeoIP2-Anonymous-IP and GeoIP2 Enterprise databases.
+	IsAnonymous bool
+	// IsAnonymousVPN is true iff the IP address is registered
+	// to an anonymous VPN provider.
+	IsAnonymousVPN bool
+	// IsHostingProvider is true iff the IP address belongs
+	// to a hosting or VPN provider.
+	IsHostingProvider bool
+	// IsPublicProxy is true iff the IP address belongs to
+	// a public proxy.
+	IsPublicProxy bool
+	// IsResidentialProxy is true iff the IP address is on a
+	// suspected anonymizing network and belongs to a
+	// residential ISP.
+	IsResidentialProxy bool
+	// IsTorExitNode is true iff the IP address is a Tor
+	// exit node.
+	IsTorExitNode bool
+	// IsAnycast is true iff the IP address belongs to an anycast
+	// network (e.g. public DNS resolvers or CDNs), so its location
+	// is not meaningful for determining where the user is.
+	IsAnycast bool
+	// UserType indicates the kind of user associated with the
+	// IP address (e.g. "residential", "business", "cellular" or
+	// "hosting"). It's only available in GeoIP2 Enterprise and
+	// GeoIP2 Insights databases.
+	UserType string
+	// ConnectionType indicates the kind of connection used by the
+	// IP address (see the ConnectionType constants). It's only
+	// available in GeoIP2-Connection-Type and GeoIP2 Enterprise
+	// databases, being empty otherwise.
+	ConnectionType ConnectionType
+	// StaticIPScore indicates how static the IP address is, from 0
+	// (dynamic, e.g. reassigned frequently to different users) to
+	// 99.99 (static). It's only available in databases including
+	// the traits.static_ip_score field, otherwise it's zero.
+	StaticIPScore float64
+	// Network is the network containing the IP address (e.g.
+	// 1.2.3.0/24), as stored by the database in traits.network.
+	// It's empty for databases which don't include it, use
+	// GeoIP.LookupNetwork for those.
+	Network string
+	// ASN is the autonomous system number associated with the
+	// IP address (autonomous_system_number in the database). It's
+	// only available in GeoLite2-ASN, GeoIP2-ISP and GeoIP2 Enterprise
+	// databases.
+	ASN int
+	// ASOrganization is the name of the organization associated
+	// with ASN (autonomous_system_organization in the database).
+	// It's available in the same databases as ASN.
+	ASOrganization string
+	// ISP is the name of the ISP associated with the IP address.
+	// It's only available in GeoIP2-ISP and GeoIP2 Enterprise
+	// databases.
+	ISP string
+	// Organization is the name of the organization associated with
+	// the IP address, which might differ from ISP (e.g. a company
+	// using a block assigned by its ISP). It's only available in
+	// GeoIP2-ISP and GeoIP2 Enterprise databases.
+	Organization string
+	// Domain is the second level domain associated with the IP
+	// address (e.g. example.com). It's only available in GeoIP2-Domain
+	// and GeoIP2 Enterprise databases.
+	Domain string
+	// coords is true iff the coordinates were found in the
+	// database.
+	coords bool
+}
+
+// HasCoordinates returns true iff the coordinates of the record
+// are known. For records decoded from a database, this means the
+// database included them, so a record located exactly at (0, 0)
+// returns true unless the database was opened with
+// TreatZeroCoordsAsMissing. For records created by other means, it
+// returns true iff either Latitude or Longitude is non-zero.
+func (r *Record) HasCoordinates() bool {
+	return r != nil && (r.coords || r.Latitude != 0 || r.Longitude != 0)
+}
+
+// Confidence holds MaxMind's confidence values, from 1 to 100, for
+// each part of a record. A value of 0 means the confidence is unknown,
+// since it's only included in GeoIP2 Enterprise databases. See
+// Record.Confidence.
+type Confidence struct {
+	Country     int
+	Subdivision int
+	City        int
+	Postal      int
+}
+
+// Confidence returns the confidence values of the country, the
+// largest subdivision, the city and the postal code of the record,
+// so they can be checked together when making risk decisions.
+func (r *Record) Confidence() Confidence {
+	if r == nil {
+		return Confidence{}
+	}
+	c := Confidence{Postal: r.PostalConfidence}
+	if r.Country != nil {
+		c.Country = r.Country.Confidence
+	}
+	if sub := r.SubdivisionAt(0); sub != nil {
+		c.Subdivision = sub.Confidence
+	}
+	if r.City != nil {
+		c.City = r.City.Confidence
+	}
+	return c
+}
+
+// IsInEuropeanUnion returns true iff the country of the record
+// is a member state of the European Union. See
+// Place.IsInEuropeanUnion.
+func (r *Record) IsInEuropeanUnion() bool {
+	return r != nil && r.Country != nil && r.Country.IsInEuropeanUnion
 }
 
 // CountryCode is a shorthand for r.Country.Code, but returns
@@ -116,79 +407,620 @@ func (r *Record) CountryCode() string {
 	return ""
 }
 
-func newPlace(val interface{}) *Place {
-	if m, ok := val.(map[string]interface{}); ok {
-		geonameId := int(m["geoname_id"].(uint32))
-		var code string
-		for _, v := range codes {
-			if c, ok := m[v].(string); ok {
-				code = c
-				break
+// SubdivisionAt returns the subdivision at the given level, where 0
+// is the largest one, or nil if the record has no subdivision at that
+// level. Unlike indexing Subdivisions directly, it never panics.
+func (r *Record) SubdivisionAt(level int) *Place {
+	if r == nil || level < 0 || level >= len(r.Subdivisions) {
+		return nil
+	}
+	return r.Subdivisions[level]
+}
+
+// BestCountryCode returns the code of the country where the record is
+// located. If that's not known, it falls back to the country where the
+// IP address is registered and, finally, to the represented country.
+// If none of them are known, the empty string is returned.
+func (r *Record) BestCountryCode() string {
+	if r == nil {
+		return ""
+	}
+	for _, v := range []*Place{r.Country, r.RegisteredCountry, r.RepresentedCountry} {
+		if v != nil && v.Code != "" {
+			return v.Code
+		}
+	}
+	return ""
+}
+
+// BestPlace returns the most specific place known for the record,
+// trying in order the City, the smallest subdivision, the Country
+// and the Continent. If none of them are known, it returns nil.
+func (r *Record) BestPlace() *Place {
+	if r == nil {
+		return nil
+	}
+	if r.City != nil {
+		return r.City
+	}
+	for ii := len(r.Subdivisions) - 1; ii >= 0; ii-- {
+		if r.Subdivisions[ii] != nil {
+			return r.Subdivisions[ii]
+		}
+	}
+	if r.Country != nil {
+		return r.Country
+	}
+	return r.Continent
+}
+
+// Clone returns a deep copy of the record, including its Places and
+// their Names. Callers which need to alter a record returned by a
+// lookup should modify a clone rather than the original one.
+func (r *Record) Clone() *Record {
+	if r == nil {
+		return nil
+	}
+	c := *r
+	c.Continent = r.Continent.Clone()
+	c.Country = r.Country.Clone()
+	c.RegisteredCountry = r.RegisteredCountry.Clone()
+	c.RepresentedCountry = r.RepresentedCountry.Clone()
+	c.City = r.City.Clone()
+	if r.Subdivisions != nil {
+		c.Subdivisions = make([]*Place, len(r.Subdivisions))
+		for ii, v := range r.Subdivisions {
+			c.Subdivisions[ii] = v.Clone()
+		}
+	}
+	return &c
+}
+
+// String returns the names of the city, the largest subdivision
+// and the country of the record, separated by commas (e.g.
+// "London, England, United Kingdom"), in the default languages (see
+// SetDefaultLanguages). Missing places are omitted.
+func (r *Record) String() string {
+	if r == nil {
+		return ""
+	}
+	var parts []string
+	for _, p := range []*Place{r.City, r.SubdivisionAt(0), r.Country} {
+		if p != nil {
+			if s := p.String(); s != "" {
+				parts = append(parts, s)
 			}
 		}
-		var name Name
-		if names, ok := m["names"].(map[string]interface{}); ok {
-			name = make(Name, len(names))
-			for k, v := range names {
-				if n, ok := v.(string); ok {
-					name[k] = n
-				}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// FlatRecord contains the most commonly used fields of a Record
+// as plain values, which is convenient for storing records as rows
+// (e.g. in a columnar store). See Record.Flat.
+type FlatRecord struct {
+	CountryISO      string
+	CountryName     string
+	SubdivisionISO  string
+	SubdivisionName string
+	City            string
+	Postal          string
+	Lat             float64
+	Lng             float64
+	TimeZone        string
+	ASN             int
+	ASOrganization  string
+	ISP             string
+}
+
+// Flat returns the most commonly used fields of r as a FlatRecord.
+// Names are returned in English and only the largest subdivision
+// is included. Missing fields are left empty.
+func (r *Record) Flat() FlatRecord {
+	if r == nil {
+		return FlatRecord{}
+	}
+	flat := FlatRecord{
+		Postal:         r.PostalCode,
+		Lat:            r.Latitude,
+		Lng:            r.Longitude,
+		TimeZone:       r.TimeZone,
+		ASN:            r.ASN,
+		ASOrganization: r.ASOrganization,
+		ISP:            r.ISP,
+	}
+	if r.Country != nil {
+		flat.CountryISO = r.Country.Code
+		flat.CountryName = r.Country.Name["en"]
+	}
+	if sub := r.SubdivisionAt(0); sub != nil {
+		flat.SubdivisionISO = sub.Code
+		flat.SubdivisionName = sub.Name["en"]
+	}
+	if r.City != nil {
+		flat.City = r.City.Name["en"]
+	}
+	return flat
+}
+
+// onlyLanguages removes the translations not included in langs
+// (besides English) from the names of all the places in r.
+func (r *Record) onlyLanguages(langs []string) {
+	places := []*Place{r.Continent, r.Country, r.RegisteredCountry, r.RepresentedCountry, r.City}
+	places = append(places, r.Subdivisions...)
+	for _, p := range places {
+		if p != nil {
+			p.Name = p.Name.only(langs)
+		}
+	}
+}
+
+// RegisteredDomain returns the registered domain (also known as
+// eTLD+1) of r.Domain, according to the public suffix list (e.g.
+// example.co.uk for mail.corp.example.co.uk). If r.Domain is empty
+// or it's a public suffix itself, the empty string is returned.
+func (r *Record) RegisteredDomain() string {
+	if r == nil || r.Domain == "" {
+		return ""
+	}
+	domain, err := publicsuffix.EffectiveTLDPlusOne(strings.ToLower(strings.TrimSuffix(r.Domain, ".")))
+	if err != nil {
+		return ""
+	}
+	return domain
+}
+
+// LocalizedNames returns the names of the places in the record in
+// the given language, falling back to English for those which lack
+// that translation. The returned map uses the keys "continent",
+// "country", "subdivision" (the largest subdivision) and "city". Places
+// not present in the record are omitted.
+func (r *Record) LocalizedNames(lang string) map[string]string {
+	names := make(map[string]string, 4)
+	if r == nil {
+		return names
+	}
+	places := []struct {
+		key   string
+		place *Place
+	}{
+		{"continent", r.Continent},
+		{"country", r.Country},
+		{"subdivision", nil},
+		{"city", r.City},
+	}
+	if len(r.Subdivisions) > 0 {
+		places[2].place = r.Subdivisions[0]
+	}
+	for _, v := range places {
+		if v.place != nil {
+			if s := v.place.Name.localizedNameOrEnglish(lang); s != "" {
+				names[v.key] = s
 			}
 		}
-		return &Place{
-			Code:      code,
-			GeonameID: geonameId,
-			Name:      name,
+	}
+	return names
+}
+
+// FieldError describes a field in a record which
+// couldn't be decoded, because of its type.
+type FieldError struct {
+	// Field is the path to the field in the database
+	// record (e.g. location.latitude).
+	Field string
+	// Value is the value found in the database.
+	Value interface{}
+	// Expected is the type expected for the value.
+	Expected string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("field %s has type %T, expecting %s", e.Field, e.Value, e.Expected)
+}
+
+// DecodeError is returned by lookups in strict mode when some
+// fields in the record couldn't be decoded. See StrictDecoding.
+type DecodeError struct {
+	// Errors contains a *FieldError for each field
+	// which couldn't be decoded.
+	Errors []error
+}
+
+func (e *DecodeError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for ii, v := range e.Errors {
+		msgs[ii] = v.Error()
+	}
+	return fmt.Sprintf("error decoding record: %s", strings.Join(msgs, "; "))
+}
+
+// recordDecoder builds Records from the raw values in the
+// database, collecting the errors found in their fields.
+type recordDecoder struct {
+	opts *options
+	errs []error
+}
+
+func (d *recordDecoder) fieldError(prefix string, key string, val interface{}, expected string) {
+	field := key
+	if prefix != "" {
+		field = prefix + "." + key
+	}
+	d.errs = append(d.errs, &FieldError{Field: field, Value: val, Expected: expected})
+}
+
+func (d *recordDecoder) mapField(m map[string]interface{}, prefix string, key string) map[string]interface{} {
+	val, ok := m[key]
+	if !ok || val == nil {
+		return nil
+	}
+	v, ok := val.(map[string]interface{})
+	if !ok {
+		d.fieldError(prefix, key, val, "map")
+	}
+	return v
+}
+
+func (d *recordDecoder) stringField(m map[string]interface{}, prefix string, key string) string {
+	val, ok := m[key]
+	if !ok || val == nil {
+		return ""
+	}
+	v, ok := val.(string)
+	if !ok {
+		d.fieldError(prefix, key, val, "string")
+	}
+	return v
+}
+
+func (d *recordDecoder) floatField(m map[string]interface{}, prefix string, key string) float64 {
+	val, ok := m[key]
+	if !ok || val == nil {
+		return 0
+	}
+	switch x := val.(type) {
+	case float64:
+		return x
+	case float32:
+		return float64(x)
+	}
+	d.fieldError(prefix, key, val, "float")
+	return 0
+}
+
+func (d *recordDecoder) intField(m map[string]interface{}, prefix string, key string) int {
+	val, ok := m[key]
+	if !ok || val == nil {
+		return 0
+	}
+	v, ok := toInt64(val)
+	if !ok {
+		d.fieldError(prefix, key, val, "integer")
+	}
+	return int(v)
+}
+
+func (d *recordDecoder) boolField(m map[string]interface{}, prefix string, key string) bool {
+	val, ok := m[key]
+	if !ok || val == nil {
+		return false
+	}
+	v, ok := val.(bool)
+	if !ok {
+		d.fieldError(prefix, key, val, "boolean")
+	}
+	return v
+}
+
+// traitBool returns the boolean trait named key. City and Country
+// databases store them in the traits map, while others (e.g.
+// Anonymous-IP) store them at the top level of the record, so
+// both are checked.
+func (d *recordDecoder) traitBool(m map[string]interface{}, key string) bool {
+	if traits := d.mapField(m, "", "traits"); traits != nil {
+		if _, ok := traits[key]; ok {
+			return d.boolField(traits, "traits", key)
+		}
+	}
+	return d.boolField(m, "", key)
+}
+
+func (d *recordDecoder) place(val interface{}, field string) *Place {
+	if val == nil {
+		return nil
+	}
+	m, ok := val.(map[string]interface{})
+	if !ok {
+		d.fieldError("", field, val, "map")
+		return nil
+	}
+	var code string
+	for _, v := range codes {
+		if code = d.stringField(m, field, v); code != "" {
+			break
+		}
+	}
+	var name Name
+	if names := d.mapField(m, field, "names"); names != nil && !d.opts.dropNames {
+		name = make(Name, len(names))
+		prefix := field + ".names"
+		for k := range names {
+			if n := d.stringField(names, prefix, k); n != "" {
+				name[k] = n
+			}
 		}
 	}
-	return nil
+	return &Place{
+		Code:              code,
+		GeonameID:         d.intField(m, field, "geoname_id"),
+		Name:              name,
+		Confidence:        d.intField(m, field, "confidence"),
+		IsInEuropeanUnion: d.boolField(m, field, "is_in_european_union"),
+	}
 }
 
-func newRecord(val interface{}) (*Record, error) {
+func roundCoordinate(v float64, decimals int) float64 {
+	p := math.Pow(10, float64(decimals))
+	return math.Round(v*p) / p
+}
+
+func (d *recordDecoder) record(val interface{}) (*Record, error) {
+	if values, ok := val.([]interface{}); ok {
+		// Some custom or merged databases store several records
+		// per network. Decode all of them and merge the results,
+		// with the first non-empty value winning for each field.
+		records := make([]*Record, len(values))
+		for ii, v := range values {
+			rec, err := d.record(v)
+			if err != nil {
+				return nil, err
+			}
+			records[ii] = rec
+		}
+		merged, _ := mergeRecords(nil, records)
+		return merged, nil
+	}
 	m, ok := val.(map[string]interface{})
 	if !ok {
 		return nil, fmt.Errorf("invalid record type %T", val)
 	}
-	var latitude, longitude float64
-	var postalCode, timeZone string
-	var metroCode int
-	var isAnonymousProxy, isSatelliteProvider bool
-	if location, ok := m["location"].(map[string]interface{}); ok {
-		latitude, _ = location["latitude"].(float64)
-		longitude, _ = location["longitude"].(float64)
-		if m := location["metro_code"]; m != nil {
-			metroCode = int(m.(uint16))
-		}
-		timeZone, _ = location["time_zone"].(string)
-	}
-	if postal, ok := m["postal"].(map[string]interface{}); ok {
-		postalCode, _ = postal["code"].(string)
-	}
-	var subdivisions []*Place
-	if subs, ok := m["subdivisions"].([]interface{}); ok {
-		for _, v := range subs {
-			if p := newPlace(v); p != nil {
-				subdivisions = append(subdivisions, p)
+	opts := d.opts
+	rec := new(Record)
+	if opts.decodes(FieldLocation) {
+		if location := d.mapField(m, "", "location"); location != nil {
+			rec.Latitude = d.floatField(location, "location", "latitude")
+			rec.Longitude = d.floatField(location, "location", "longitude")
+			_, hasLat := location["latitude"]
+			_, hasLon := location["longitude"]
+			rec.coords = hasLat && hasLon
+			if opts.zeroCoordsMissing && rec.Latitude == 0 && rec.Longitude == 0 {
+				rec.coords = false
+			}
+			rec.MetroCode = d.intField(location, "location", "metro_code")
+			rec.TimeZone = d.stringField(location, "location", "time_zone")
+		}
+		if opts.roundCoords {
+			rec.Latitude = roundCoordinate(rec.Latitude, opts.coordPrecision)
+			rec.Longitude = roundCoordinate(rec.Longitude, opts.coordPrecision)
+		}
+	}
+	if opts.decodes(FieldPostal) {
+		if postal := d.mapField(m, "", "postal"); postal != nil {
+			rec.PostalCode = d.stringField(postal, "postal", "code")
+			rec.PostalConfidence = d.intField(postal, "postal", "confidence")
+		}
+	}
+	if opts.decodes(FieldSubdivisions) {
+		if subs, ok := m["subdivisions"].([]interface{}); ok {
+			for _, v := range subs {
+				p := d.place(v, "subdivisions")
+				if p == nil {
+					continue
+				}
+				if p.Code == "" {
+					switch opts.subdivisionCodes {
+					case SubdivisionCodesSkip:
+						continue
+					case SubdivisionCodesGeonameID:
+						if p.GeonameID == 0 {
+							continue
+						}
+						p.Code = strconv.Itoa(p.GeonameID)
+					}
+				}
+				rec.Subdivisions = append(rec.Subdivisions, p)
+			}
+		} else if subs := m["subdivisions"]; subs != nil {
+			d.fieldError("", "subdivisions", subs, "array")
+		}
+	}
+	if opts.decodes(FieldTraits) {
+		rec.IsAnonymousProxy = d.traitBool(m, "is_anonymous_proxy")
+		rec.IsSatelliteProvider = d.traitBool(m, "is_satellite_provider")
+		rec.IsAnonymous = d.traitBool(m, "is_anonymous")
+		rec.IsAnonymousVPN = d.traitBool(m, "is_anonymous_vpn")
+		rec.IsHostingProvider = d.traitBool(m, "is_hosting_provider")
+		rec.IsPublicProxy = d.traitBool(m, "is_public_proxy")
+		rec.IsResidentialProxy = d.traitBool(m, "is_residential_proxy")
+		rec.IsTorExitNode = d.traitBool(m, "is_tor_exit_node")
+		rec.IsAnycast = d.traitBool(m, "is_anycast")
+		traits := d.mapField(m, "", "traits")
+		if traits != nil {
+			rec.UserType = d.stringField(traits, "traits", "user_type")
+			rec.ConnectionType = ConnectionType(d.stringField(traits, "traits", "connection_type"))
+			rec.StaticIPScore = d.floatField(traits, "traits", "static_ip_score")
+			rec.Network = d.stringField(traits, "traits", "network")
+		}
+		// Connection-Type databases also store it at the top level
+		if _, ok := m["connection_type"]; ok {
+			rec.ConnectionType = ConnectionType(d.stringField(m, "", "connection_type"))
+		}
+	}
+	if opts.decodes(FieldASN) {
+		// Invalid traits are reported with FieldTraits
+		if traits, ok := m["traits"].(map[string]interface{}); ok {
+			rec.ASN = d.intField(traits, "traits", "autonomous_system_number")
+			rec.ASOrganization = d.stringField(traits, "traits", "autonomous_system_organization")
+			rec.ISP = d.stringField(traits, "traits", "isp")
+			rec.Organization = d.stringField(traits, "traits", "organization")
+		}
+		// ASN and ISP databases store them at the top level
+		if _, ok := m["autonomous_system_number"]; ok {
+			rec.ASN = d.intField(m, "", "autonomous_system_number")
+		}
+		if _, ok := m["autonomous_system_organization"]; ok {
+			rec.ASOrganization = d.stringField(m, "", "autonomous_system_organization")
+		}
+		if _, ok := m["isp"]; ok {
+			rec.ISP = d.stringField(m, "", "isp")
+		}
+		if _, ok := m["organization"]; ok {
+			rec.Organization = d.stringField(m, "", "organization")
+		}
+	}
+	rec.Domain = d.stringField(m, "", "domain")
+	if rec.Domain == "" {
+		// GeoIP2 Enterprise stores it in the traits
+		if traits, ok := m["traits"].(map[string]interface{}); ok {
+			rec.Domain = d.stringField(traits, "traits", "domain")
+		}
+	}
+	if opts.decodes(FieldContinent) {
+		rec.Continent = d.place(m["continent"], "continent")
+	}
+	if opts.decodes(FieldCountry) {
+		rec.Country = d.place(m["country"], "country")
+		rec.RegisteredCountry = d.place(m["registered_country"], "registered_country")
+		rec.RepresentedCountry = d.place(m["represented_country"], "represented_country")
+	}
+	if opts.decodes(FieldCity) {
+		rec.City = d.place(m["city"], "city")
+	}
+	return rec, nil
+}
+
+// recordKeys maps the top level keys used by recordDecoder.record
+// to the section which uses them, so decodeRecord can skip the keys
+// which won't be used. Keep it in sync with record, keys which are
+// not listed here are never decoded.
+var recordKeys = map[string]Field{
+	"continent":                      FieldContinent,
+	"country":                        FieldCountry,
+	"registered_country":             FieldCountry,
+	"represented_country":            FieldCountry,
+	"city":                           FieldCity,
+	"subdivisions":                   FieldSubdivisions,
+	"location":                       FieldLocation,
+	"postal":                         FieldPostal,
+	"is_anonymous_proxy":             FieldTraits,
+	"is_satellite_provider":          FieldTraits,
+	"is_anonymous":                   FieldTraits,
+	"is_anonymous_vpn":               FieldTraits,
+	"is_hosting_provider":            FieldTraits,
+	"is_public_proxy":                FieldTraits,
+	"is_residential_proxy":           FieldTraits,
+	"is_tor_exit_node":               FieldTraits,
+	"is_anycast":                     FieldTraits,
+	"autonomous_system_number":       FieldASN,
+	"autonomous_system_organization": FieldASN,
+	"isp":                            FieldASN,
+	"organization":                   FieldASN,
+	"connection_type":                FieldTraits,
+	// Always decoded, traits include the domain
+	// in GeoIP2 Enterprise databases
+	"domain": FieldAll,
+	"traits": FieldAll,
+}
+
+// placeKeys are the top level keys whose values are
+// decoded with recordDecoder.place.
+var placeKeys = map[string]bool{
+	"continent":           true,
+	"country":             true,
+	"registered_country":  true,
+	"represented_country": true,
+	"city":                true,
+	"subdivisions":        true,
+}
+
+// decodeRecord works like decode, but only decodes the top level
+// keys which will be used by newRecord with the given options
+// (see recordKeys), skipping the rest. When names are dropped (see
+// DropNames), place names are skipped too. This saves most of the
+// allocations for lookups which only need some sections.
+func (d *decoder) decodeRecord(opts *options) (interface{}, error) {
+	start := d.at
+	t, size, err := d.decodeType()
+	if err != nil {
+		return nil, err
+	}
+	switch t {
+	case typePointer:
+		dec := &decoder{d.data, size}
+		return dec.decodeRecord(opts)
+	case typeArray:
+		values := make([]interface{}, size)
+		for ii := range values {
+			if values[ii], err = d.decodeRecord(opts); err != nil {
+				return nil, err
 			}
 		}
+		return values, nil
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for ii := 0; ii < size; ii++ {
+			key, err := d.decodeKey()
+			if err != nil {
+				return nil, err
+			}
+			// No allocation for the conversion
+			field, ok := recordKeys[string(key)]
+			if !ok || (field != FieldAll && !opts.decodes(field)) {
+				if err := d.skip(); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			k := string(key)
+			var value interface{}
+			if opts.dropNames && placeKeys[k] {
+				value, err = d.decodeSkipping("names")
+			} else {
+				value, err = d.decode()
+			}
+			if err != nil {
+				return nil, err
+			}
+			m[k] = value
+		}
+		return m, nil
+	}
+	d.at = start
+	return d.decode()
+}
+
+// newRecord decodes a Record from the raw value stored in the
+// database. Fields which can't be decoded are left empty, unless
+// strict decoding is enabled, in which case a *DecodeError is
+// returned.
+func newRecord(val interface{}, opts *options) (*Record, error) {
+	rec, warnings, err := newRecordWarnings(val, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.strict && len(warnings) > 0 {
+		return nil, &DecodeError{Errors: warnings}
+	}
+	return rec, nil
+}
+
+// newRecordWarnings works like newRecord, but returns the errors
+// found while decoding the fields rather than failing.
+func newRecordWarnings(val interface{}, opts *options) (*Record, []error, error) {
+	d := &recordDecoder{opts: opts}
+	rec, err := d.record(val)
+	if err != nil {
+		return nil, nil, err
 	}
-	if traits, ok := m["traits"].(map[string]interface{}); ok {
-		isAnonymousProxy, _ = traits["is_anonymous_proxy"].(bool)
-		isSatelliteProvider, _ = traits["is_satellite_provider"].(bool)
-	}
-	return &Record{
-		Continent:           newPlace(m["continent"]),
-		Country:             newPlace(m["country"]),
-		RegisteredCountry:   newPlace(m["registered_country"]),
-		RepresentedCountry:  newPlace(m["represented_country"]),
-		City:                newPlace(m["city"]),
-		Subdivisions:        subdivisions,
-		Latitude:            latitude,
-		Longitude:           longitude,
-		MetroCode:           metroCode,
-		PostalCode:          postalCode,
-		TimeZone:            timeZone,
-		IsAnonymousProxy:    isAnonymousProxy,
-		IsSatelliteProvider: isSatelliteProvider,
-	}, nil
+	return rec, d.errs, nil
 }
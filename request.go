@@ -0,0 +1,152 @@
+package geoip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+type requestOptions struct {
+	trustedProxies []string
+}
+
+// RequestOpt is a function type which allows setting options
+// for LookupRequest and ClientIP. See RequestTrustedProxies.
+type RequestOpt func(*requestOptions)
+
+// RequestTrustedProxies sets the proxies whose forwarding headers
+// are trusted, as IP addresses (e.g. 10.0.0.1) or networks (e.g.
+// 10.0.0.0/8). Invalid entries make ClientIP and LookupRequest
+// return an error. Since these headers can be set by anyone, they're
+// ignored unless the request comes from a trusted proxy.
+func RequestTrustedProxies(proxies ...string) RequestOpt {
+	return func(opts *requestOptions) {
+		opts.trustedProxies = append(opts.trustedProxies, proxies...)
+	}
+}
+
+// ClientIP returns the IP address of the client which sent r. By
+// default, this is the address in r.RemoteAddr. If r was sent by a
+// trusted proxy (see RequestTrustedProxies), the Forwarded,
+// X-Forwarded-For and X-Real-IP headers are checked, in that order,
+// and the client IP is the rightmost address which is not a trusted
+// proxy. This prevents clients from spoofing their address by adding
+// their own headers, since only the addresses appended by trusted
+// proxies are considered.
+func ClientIP(r *http.Request, opts ...RequestOpt) (net.IP, error) {
+	var o requestOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	trusted := make([]netip.Prefix, 0, len(o.trustedProxies))
+	for _, v := range o.trustedProxies {
+		prefix, err := parsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", v, err)
+		}
+		trusted = append(trusted, prefix)
+	}
+	isTrusted := func(addr netip.Addr) bool {
+		addr = addr.Unmap()
+		for _, v := range trusted {
+			if v.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+	remote, err := parseHostAddr(r.RemoteAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote address %q: %v", r.RemoteAddr, err)
+	}
+	if isTrusted(remote) {
+		for _, addrs := range [][]string{
+			forwardedFor(r.Header.Values("Forwarded")),
+			splitHeader(r.Header.Values("X-Forwarded-For")),
+			splitHeader(r.Header.Values("X-Real-IP")),
+		} {
+			if len(addrs) == 0 {
+				continue
+			}
+			client := remote
+			for ii := len(addrs) - 1; ii >= 0 && isTrusted(client); ii-- {
+				addr, err := parseHostAddr(addrs[ii])
+				if err != nil {
+					// Obfuscated or unknown, stop at the last
+					// valid address
+					break
+				}
+				client = addr
+			}
+			return net.IP(client.Unmap().AsSlice()), nil
+		}
+	}
+	return net.IP(remote.Unmap().AsSlice()), nil
+}
+
+// LookupRequest returns the record for the client which sent r,
+// obtaining its address with ClientIP.
+func (g *GeoIP) LookupRequest(r *http.Request, opts ...RequestOpt) (*Record, error) {
+	ip, err := ClientIP(r, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return g.LookupIP(ip)
+}
+
+// parsePrefix parses an IP address or a CIDR as a netip.Prefix.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// parseHostAddr parses an IP address with an optional
+// port (e.g. 192.0.2.1:80 or [2001:db8::1]:80).
+func parseHostAddr(s string) (netip.Addr, error) {
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr(), nil
+	}
+	return netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+}
+
+// splitHeader returns the comma separated values
+// in the given header values.
+func splitHeader(values []string) []string {
+	var res []string
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				res = append(res, s)
+			}
+		}
+	}
+	return res
+}
+
+// forwardedFor returns the for parameters in the
+// given Forwarded header values (see RFC 7239).
+func forwardedFor(values []string) []string {
+	var res []string
+	for _, elem := range splitHeader(values) {
+		for _, pair := range strings.Split(elem, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(key, "for") {
+				res = append(res, strings.Trim(value, `"`))
+			}
+		}
+	}
+	return res
+}
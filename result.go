@@ -0,0 +1,312 @@
+package geoip
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"reflect"
+	"runtime"
+	"strings"
+)
+
+var (
+	bigIntType = reflect.TypeOf(big.Int{})
+)
+
+// Result represents the location of a record in the database,
+// as found by the search tree. It allows decoding the record
+// into arbitrary types, which is useful for databases with a
+// schema not covered by Record. Use LookupDecoder to obtain
+// a Result.
+type Result struct {
+	db  *database
+	ptr int
+}
+
+// LookupDecoder finds the record for the given IP, but rather
+// than decoding it into a Record returns a *Result, which can
+// be used to decode the data into a custom type.
+func (g *GeoIP) LookupDecoder(ip net.IP) (*Result, error) {
+	db := g.current()
+	p, err := db.lookupIPPointer(ip)
+	if err != nil {
+		return nil, err
+	}
+	return &Result{db: db, ptr: p}, nil
+}
+
+// Value returns the raw value of the record. See
+// GeoIP.LookupIPValue for more information.
+func (r *Result) Value() (interface{}, error) {
+	return r.db.lookupResult(r.ptr)
+}
+
+// Decode decodes the record into v, which must be a non-nil pointer.
+// Maps are decoded into structs by matching each key to the field
+// with the same name in its `maxminddb` tag (e.g. `maxminddb:"iso_code"`)
+// or, for untagged fields, to the field name with a case insensitive
+// comparison. Fields tagged with `maxminddb:"-"` are ignored, as well
+// as keys without a matching field. Arrays are decoded into slices and
+// uint128 values into *big.Int. Any value can be decoded into an
+// interface{}, which receives the raw value. Only the values with a
+// matching field are decoded, the rest are skipped.
+func (r *Result) Decode(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("can't decode into a non-pointer or a nil pointer")
+	}
+	defer runtime.KeepAlive(r.db)
+	d := decoder{r.db.data, r.ptr - r.db.nodeCount - 16}
+	return d.decodeInto(rv.Elem())
+}
+
+// LookupInto finds the record for the given IP and decodes it into
+// v, which is usually a pointer to a struct with only the fields the
+// caller needs. It's a shorthand for LookupDecoder followed by
+// Result.Decode, see the latter for the supported types. Since the
+// keys without a matching field are skipped rather than decoded, this
+// is faster and allocates less than LookupIP. e.g.
+//
+//	var rec struct {
+//		Country struct {
+//			ISOCode string `maxminddb:"iso_code"`
+//		} `maxminddb:"country"`
+//	}
+//	err := db.LookupInto(ip, &rec)
+func (g *GeoIP) LookupInto(ip net.IP, v interface{}) error {
+	res, err := g.LookupDecoder(ip)
+	if err != nil {
+		return err
+	}
+	return res.Decode(v)
+}
+
+// isContainer returns true iff values of the given type are
+// decoded directly from the data section by decodeInto, rather
+// than decoded first and then stored with unmarshalValue.
+func isContainer(typ reflect.Type) bool {
+	switch typ.Kind() {
+	case reflect.Struct:
+		return typ != bigIntType
+	case reflect.Map:
+		return typ.Key().Kind() == reflect.String
+	case reflect.Slice:
+		return typ.Elem().Kind() != reflect.Uint8
+	}
+	return false
+}
+
+// decodeInto decodes the current value into dst. Maps and arrays
+// are decoded item by item, skipping map keys without a matching
+// struct field, while other values are decoded and then stored
+// with unmarshalValue.
+func (d *decoder) decodeInto(dst reflect.Value) error {
+	if dst.Kind() == reflect.Ptr && dst.Type().Elem() != bigIntType {
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		return d.decodeInto(dst.Elem())
+	}
+	if !isContainer(dst.Type()) {
+		val, err := d.decode()
+		if err != nil {
+			return err
+		}
+		return unmarshalValue(val, dst)
+	}
+	t, size, err := d.decodeType()
+	if err != nil {
+		return err
+	}
+	dec := d
+	if t == typePointer {
+		dec = &decoder{d.data, size}
+		if t, size, err = dec.decodeType(); err != nil {
+			return err
+		}
+	}
+	switch {
+	case t == typeMap && dst.Kind() == reflect.Struct:
+		return dec.decodeStruct(size, dst)
+	case t == typeMap && dst.Kind() == reflect.Map:
+		typ := dst.Type()
+		if dst.IsNil() {
+			dst.Set(reflect.MakeMapWithSize(typ, size))
+		}
+		for ii := 0; ii < size; ii++ {
+			key, err := dec.decodeString()
+			if err != nil {
+				return err
+			}
+			elem := reflect.New(typ.Elem()).Elem()
+			if err := dec.decodeInto(elem); err != nil {
+				return err
+			}
+			dst.SetMapIndex(reflect.ValueOf(key).Convert(typ.Key()), elem)
+		}
+		return nil
+	case t == typeArray && dst.Kind() == reflect.Slice:
+		s := reflect.MakeSlice(dst.Type(), size, size)
+		for ii := 0; ii < size; ii++ {
+			if err := dec.decodeInto(s.Index(ii)); err != nil {
+				return err
+			}
+		}
+		dst.Set(s)
+		return nil
+	}
+	return fmt.Errorf("can't decode type %d into %s", t, dst.Type())
+}
+
+func (d *decoder) decodeStruct(size int, dst reflect.Value) error {
+	typ := dst.Type()
+	for ii := 0; ii < size; ii++ {
+		key, err := d.decodeString()
+		if err != nil {
+			return err
+		}
+		idx := fieldIndex(typ, key)
+		if idx < 0 {
+			if err := d.skip(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := d.decodeInto(dst.Field(idx)); err != nil {
+			return fmt.Errorf("error decoding field %s: %v", typ.Field(idx).Name, err)
+		}
+	}
+	return nil
+}
+
+// fieldIndex returns the index of the field in typ which should
+// receive the value for the given key, or -1 if there's none.
+func fieldIndex(typ reflect.Type, key string) int {
+	fold := -1
+	for ii := 0; ii < typ.NumField(); ii++ {
+		field := typ.Field(ii)
+		if field.PkgPath != "" {
+			// unexported
+			continue
+		}
+		name := field.Tag.Get("maxminddb")
+		if name == "" {
+			if field.Name == key {
+				return ii
+			}
+			if fold < 0 && strings.EqualFold(field.Name, key) {
+				fold = ii
+			}
+			continue
+		}
+		if name == key {
+			return ii
+		}
+	}
+	return fold
+}
+
+// unmarshalValue stores the decoded value val, which must not be
+// a map or an array, into dst.
+func unmarshalValue(val interface{}, dst reflect.Value) error {
+	if val == nil {
+		return nil
+	}
+	switch dst.Kind() {
+	case reflect.Ptr:
+		if dst.IsNil() {
+			if dst.Type().Elem() == bigIntType {
+				if n, ok := val.(*big.Int); ok {
+					dst.Set(reflect.ValueOf(n))
+					return nil
+				}
+			}
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		return unmarshalValue(val, dst.Elem())
+	case reflect.Interface:
+		if dst.NumMethod() == 0 {
+			dst.Set(reflect.ValueOf(val))
+			return nil
+		}
+	case reflect.Struct:
+		if dst.Type() == bigIntType {
+			switch x := val.(type) {
+			case *big.Int:
+				dst.Set(reflect.ValueOf(x).Elem())
+				return nil
+			case uint64:
+				dst.Set(reflect.ValueOf(new(big.Int).SetUint64(x)).Elem())
+				return nil
+			}
+		}
+	case reflect.Slice:
+		if x, ok := val.([]byte); ok && dst.Type().Elem().Kind() == reflect.Uint8 {
+			dst.SetBytes(x)
+			return nil
+		}
+	case reflect.String:
+		if s, ok := val.(string); ok {
+			dst.SetString(s)
+			return nil
+		}
+	case reflect.Bool:
+		if b, ok := val.(bool); ok {
+			dst.SetBool(b)
+			return nil
+		}
+	case reflect.Float32, reflect.Float64:
+		switch x := val.(type) {
+		case float64:
+			dst.SetFloat(x)
+			return nil
+		case float32:
+			dst.SetFloat(float64(x))
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n, ok := toInt64(val); ok && !dst.OverflowInt(n) {
+			dst.SetInt(n)
+			return nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if n, ok := toUint64(val); ok && !dst.OverflowUint(n) {
+			dst.SetUint(n)
+			return nil
+		}
+	}
+	return fmt.Errorf("can't decode %T into %s", val, dst.Type())
+}
+
+func toInt64(val interface{}) (int64, bool) {
+	switch x := val.(type) {
+	case int32:
+		return int64(x), true
+	case uint16:
+		return int64(x), true
+	case uint32:
+		return int64(x), true
+	case uint64:
+		if x <= 1<<63-1 {
+			return int64(x), true
+		}
+	}
+	return 0, false
+}
+
+func toUint64(val interface{}) (uint64, bool) {
+	switch x := val.(type) {
+	case int32:
+		if x >= 0 {
+			return uint64(x), true
+		}
+	case uint16:
+		return uint64(x), true
+	case uint32:
+		return uint64(x), true
+	case uint64:
+		return x, true
+	}
+	return 0, false
+}
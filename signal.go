@@ -0,0 +1,80 @@
+package geoip
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// ReloadOnSignal starts a goroutine which reloads the database from
+// its original source each time the process receives one of the given
+// signals, or SIGHUP if none are given. This matches how daemons are
+// usually told to pick up updated data. Databases opened with Open or
+// OpenMmap are reloaded from their file (see GeoIP.Reload), while the
+// ones opened with OpenURL are downloaded again. After each reload, fn
+// is called with its error, if any. When a reload fails, the previous
+// database is kept. fn might be nil, in which case errors are logged
+// (see ErrorLog). The goroutine runs until g is closed with
+// GeoIP.Close, which also cancels the download in progress, if any.
+// fn might call GeoIP.Close, in which case Close returns without
+// waiting for fn to finish. If the source of the database is
+// not known (e.g. it was opened with New), an error is returned.
+func (g *GeoIP) ReloadOnSignal(fn func(err error), sigs ...os.Signal) error {
+	if g.source == nil {
+		return errors.New("can't reload a database without a known source, open it with Open, OpenMmap or OpenURL")
+	}
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGHUP}
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	// Cancelled when g is closed, so Close doesn't
+	// have to wait for a download in progress
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	// Set while calling fn, which might close g. Waiting
+	// for done in that case would deadlock.
+	var inCallback atomic.Bool
+	g.onClose(func() {
+		signal.Stop(ch)
+		cancel()
+		if !inCallback.Load() {
+			<-done
+		}
+	})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ch:
+			}
+			err := g.reloadSource(ctx)
+			if err == ErrClosed || ctx.Err() != nil {
+				return
+			}
+			if fn != nil {
+				inCallback.Store(true)
+				fn(err)
+				inCallback.Store(false)
+			} else if err != nil {
+				g.logf("geoip: error reloading database: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// reloadSource reloads the database from the source it was
+// loaded from, which must be known.
+func (g *GeoIP) reloadSource(ctx context.Context) error {
+	src := g.source
+	if src.url != "" {
+		return g.reloadURL(ctx, src.url, src.resolved, src.urlOpts)
+	}
+	return g.Reload(src.filename)
+}
@@ -0,0 +1,63 @@
+package geoip
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// URLVerifySignature makes OpenURL verify the downloaded database
+// against its detached PGP signature, using the given armored public
+// key. The signature is downloaded from the same URL with .asc appended
+// to its path or, for MaxMind URLs with a suffix parameter, to the
+// suffix (e.g. suffix=tar.gz.asc). If the signature is missing or
+// doesn't match, the download fails, so the cached database is used
+// instead if there's one, and the unverified data is never cached
+// nor returned.
+func URLVerifySignature(pubkey string) URLOpt {
+	return func(opts *urlOptions) {
+		opts.SignatureKey = pubkey
+	}
+}
+
+// signatureURL returns the URL of the detached signature
+// for the database at rawurl.
+func signatureURL(rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	if suffix := query.Get("suffix"); suffix != "" {
+		query.Set("suffix", suffix+".asc")
+		u.RawQuery = query.Encode()
+	} else {
+		u.Path += ".asc"
+	}
+	return u.String(), nil
+}
+
+// verifySignature downloads the detached signature for the
+// database at rawurl and checks data against it.
+func (o *urlOptions) verifySignature(ctx context.Context, rawurl string, data []byte) error {
+	keyring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(o.SignatureKey))
+	if err != nil {
+		return fmt.Errorf("invalid signature public key: %v", err)
+	}
+	sigURL, err := signatureURL(rawurl)
+	if err != nil {
+		return err
+	}
+	sig, err := o.get(ctx, sigURL)
+	if err != nil {
+		return fmt.Errorf("error downloading signature: %v", err)
+	}
+	if _, err := openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(data), bytes.NewReader(sig), nil); err != nil {
+		return fmt.Errorf("invalid database signature: %v", err)
+	}
+	return nil
+}
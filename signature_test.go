@@ -0,0 +1,81 @@
+package geoip
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+func testSigningKey(t *testing.T) (*openpgp.Entity, string) {
+	entity, err := openpgp.NewEntity("geoip", "", "geoip@example.com", &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	return entity, buf.String()
+}
+
+func TestOpenURLVerifySignature(t *testing.T) {
+	data := readFile(t, "GeoIP2-City-Test.mmdb")
+	signer, pubkey := testSigningKey(t)
+	var sig bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&sig, signer, bytes.NewReader(data), nil); err != nil {
+		t.Fatal(err)
+	}
+	other, _ := testSigningKey(t)
+	var otherSig bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&otherSig, other, bytes.NewReader(data), nil); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/db.mmdb", func(w http.ResponseWriter, r *http.Request) { w.Write(data) })
+	mux.HandleFunc("/db.mmdb.asc", func(w http.ResponseWriter, r *http.Request) { w.Write(sig.Bytes()) })
+	mux.HandleFunc("/other.mmdb", func(w http.ResponseWriter, r *http.Request) { w.Write(data) })
+	mux.HandleFunc("/other.mmdb.asc", func(w http.ResponseWriter, r *http.Request) { w.Write(otherSig.Bytes()) })
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	dir := t.TempDir()
+	if _, err := OpenURL(srv.URL+"/db.mmdb", URLCacheDir(dir), URLVerifySignature(pubkey)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenURL(srv.URL+"/other.mmdb", URLCacheDir(dir), URLVerifySignature(pubkey)); err == nil {
+		t.Error("expecting an error with a signature from another key")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "other.mmdb")); !os.IsNotExist(err) {
+		t.Errorf("unverified database was cached: %v", err)
+	}
+}
+
+func TestSignatureURL(t *testing.T) {
+	for _, v := range []struct {
+		url      string
+		expected string
+	}{
+		{"https://example.com/db.mmdb.gz", "https://example.com/db.mmdb.gz.asc"},
+		{"https://download.maxmind.com/app/geoip_download?edition_id=GeoLite2-City&license_key=foo&suffix=tar.gz",
+			"https://download.maxmind.com/app/geoip_download?edition_id=GeoLite2-City&license_key=foo&suffix=tar.gz.asc"},
+	} {
+		u, err := signatureURL(v.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u != v.expected {
+			t.Errorf("expecting signature URL %s for %s, got %s", v.expected, v.url, u)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package geoip
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Format indicates the output format used by LookupStream.
+type Format int
+
+const (
+	// FormatJSON writes a JSON object per line, with the keys ip
+	// and either record, containing the Record, or error.
+	FormatJSON Format = iota
+	// FormatCSV writes a header row and then a row per address
+	// with the columns ip, country, subdivision, city, latitude,
+	// longitude and error.
+	FormatCSV
+)
+
+type streamResult struct {
+	IP     string  `json:"ip"`
+	Record *Record `json:"record,omitempty"`
+	Error  string  `json:"error,omitempty"`
+}
+
+// LookupStream reads IP addresses from r, one per line, and writes
+// their records to w in the given format. Blank lines are skipped,
+// while addresses which can't be parsed or looked up are reported
+// inline, with the error message, rather than aborting the whole
+// stream. The returned error is non-nil only when reading from r or
+// writing to w fails, or when format is not valid.
+func (g *GeoIP) LookupStream(r io.Reader, w io.Writer, format Format) error {
+	var write func(res *streamResult) error
+	var flush func() error
+	switch format {
+	case FormatJSON:
+		bw := bufio.NewWriter(w)
+		enc := json.NewEncoder(bw)
+		write = func(res *streamResult) error { return enc.Encode(res) }
+		flush = bw.Flush
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write([]string{"ip", "country", "subdivision", "city", "latitude", "longitude", "error"}); err != nil {
+			return err
+		}
+		write = func(res *streamResult) error { return cw.Write(csvRow(res)) }
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	default:
+		return fmt.Errorf("invalid format %d", format)
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		addr := strings.TrimSpace(scanner.Text())
+		if addr == "" {
+			continue
+		}
+		res := &streamResult{IP: addr}
+		rec, err := g.Lookup(addr)
+		if err != nil {
+			res.Error = err.Error()
+		} else {
+			res.Record = rec
+		}
+		if err := write(res); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		// Don't lose the results written so far
+		flush()
+		return err
+	}
+	return flush()
+}
+
+func csvRow(res *streamResult) []string {
+	row := []string{res.IP, "", "", "", "", "", res.Error}
+	if rec := res.Record; rec != nil {
+		row[1] = rec.CountryCode()
+		if sub := rec.SubdivisionAt(0); sub != nil {
+			row[2] = sub.Code
+		}
+		if rec.City != nil {
+			row[3] = rec.City.Name.String()
+		}
+		if rec.HasCoordinates() {
+			row[4] = strconv.FormatFloat(rec.Latitude, 'f', -1, 64)
+			row[5] = strconv.FormatFloat(rec.Longitude, 'f', -1, 64)
+		}
+	}
+	return row
+}
@@ -0,0 +1,55 @@
+package geoip
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+var asciiReplacer = strings.NewReplacer(
+	"ß", "ss",
+	"æ", "ae", "Æ", "AE",
+	"œ", "oe", "Œ", "OE",
+	"ø", "o", "Ø", "O",
+	"ł", "l", "Ł", "L",
+	"đ", "d", "Đ", "D",
+	"ð", "d", "Ð", "D",
+	"þ", "th", "Þ", "Th",
+	"ı", "i",
+)
+
+// ASCII returns the name in the given language if it only contains
+// ASCII characters. Otherwise, it falls back to the English name,
+// with any diacritics removed (e.g. Zürich becomes Zurich). Characters
+// which can't be transliterated are dropped. This is intended for
+// systems which can only handle ASCII text.
+func (n Name) ASCII(lang string) string {
+	if s := n.LocalizedNameFallback(lang); s != "" && isASCII(s) {
+		return s
+	}
+	return toASCII(n["en"])
+}
+
+func isASCII(s string) bool {
+	for ii := 0; ii < len(s); ii++ {
+		if s[ii] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+func toASCII(s string) string {
+	if isASCII(s) {
+		return s
+	}
+	s = asciiReplacer.Replace(norm.NFD.String(s))
+	return strings.Map(func(r rune) rune {
+		if r >= utf8.RuneSelf || unicode.Is(unicode.Mn, r) {
+			return -1
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,963 @@
+package geoip
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func testServer(t testing.TB, filename string) *httptest.Server {
+	return testDataServer(t, readFile(t, filename))
+}
+
+func testDataServer(t testing.TB, data []byte) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestOpenURL(t *testing.T) {
+	srv := testServer(t, "GeoIP2-City-Test.mmdb.gz")
+	dir := t.TempDir()
+	geo, err := OpenURL(srv.URL+"/GeoIP2-City-Test.mmdb.gz", URLCacheDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := geo.Lookup("81.2.69.160"); err != nil {
+		t.Error(err)
+	}
+	srv.Close()
+	// Should be loaded from the cache
+	if _, err := OpenURL(srv.URL+"/GeoIP2-City-Test.mmdb.gz", URLCacheDir(dir)); err != nil {
+		t.Error(err)
+	}
+	if _, err := Open(filepath.Join(dir, "GeoIP2-City-Test.mmdb.gz")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOpenURLMaxSize(t *testing.T) {
+	srv := testServer(t, "GeoIP2-City-Test.mmdb.gz")
+	url := srv.URL + "/GeoIP2-City-Test.mmdb.gz"
+	if _, err := OpenURL(url, URLCacheDir(""), URLMaxSize(1024)); err == nil {
+		t.Error("expecting an error when exceeding the maximum size")
+	}
+	if _, err := OpenURL(url, URLCacheDir(""), URLMaxSize(1<<20)); err != nil {
+		t.Error(err)
+	}
+}
+
+// tarGz returns the files, as name and data pairs, archived
+// in the same format used by MaxMind downloads.
+func tarGz(t testing.TB, files ...string) []byte {
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	for ii := 0; ii < len(files); ii += 2 {
+		name, data := files[ii], files[ii+1]
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestOpenURLTarGz(t *testing.T) {
+	data := readFile(t, "GeoIP2-City-Test.mmdb")
+	srv := testDataServer(t, tarGz(t,
+		"GeoIP2-City-Test_20170217/LICENSE.txt", "license",
+		"GeoIP2-City-Test_20170217/GeoIP2-City-Test.mmdb", string(data),
+	))
+	dir := t.TempDir()
+	url := srv.URL + "/app/geoip_download?edition_id=GeoIP2-City-Test&suffix=tar.gz"
+	if _, err := OpenURL(url, URLCacheDir(dir), URLCacheName("GeoIP2-City-Test.mmdb")); err != nil {
+		t.Fatal(err)
+	}
+	cached := filepath.Join(dir, "GeoIP2-City-Test.mmdb")
+	if _, err := Open(cached); err != nil {
+		t.Errorf("error opening cached database: %v", err)
+	}
+}
+
+func TestOpenURLAllowShortCache(t *testing.T) {
+	data := readFile(t, "GeoIP2-City-Test.mmdb")
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write(data)
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	url := srv.URL + "/maxmind.com/GeoIP2-City-Test.mmdb"
+	for ii := 0; ii < 2; ii++ {
+		if _, err := OpenURL(url, URLCacheDir(dir), URLCacheExpiration(0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("expecting 1 request with the MaxMind clamp, got %d", requests)
+	}
+	for ii := 0; ii < 2; ii++ {
+		if _, err := OpenURL(url, URLCacheDir(dir), URLCacheExpiration(0), URLAllowShortCache()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if requests != 3 {
+		t.Errorf("expecting 3 requests without the MaxMind clamp, got %d", requests)
+	}
+}
+
+func TestOpenTemp(t *testing.T) {
+	srv := testServer(t, "GeoIP2-City-Test.mmdb")
+	opts := make([]URLOpt, 0, 2)
+	opts = append(opts, URLCacheExpiration(time.Hour))
+	geo, cleanup, err := OpenTemp(srv.URL+"/GeoIP2-City-Test.mmdb", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts[:cap(opts)][len(opts)] != nil {
+		t.Error("OpenTemp modified the options passed by the caller")
+	}
+	if _, err := geo.Lookup("81.2.69.160"); err != nil {
+		t.Error(err)
+	}
+	if err := cleanup(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOpenMaxMindCacheName(t *testing.T) {
+	data := readFile(t, "GeoIP2-City-Test.mmdb")
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(bytes.NewReader(data)),
+			Request:    r,
+		}, nil
+	})
+	dir := t.TempDir()
+	opts := make([]URLOpt, 0, 4)
+	opts = append(opts, URLCacheDir(dir), URLLicenseKey("key"), URLTransport(transport))
+	if _, err := OpenMaxMind("GeoIP2-City", opts...); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "GeoIP2-City.mmdb")); err != nil {
+		t.Error(err)
+	}
+	if opts[:cap(opts)][len(opts)] != nil {
+		t.Error("OpenMaxMind modified the options passed by the caller")
+	}
+	// A cache name set by the caller wins
+	if _, err := OpenMaxMind("GeoIP2-City", append(opts, URLCacheName("custom.mmdb"))...); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "custom.mmdb")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNormalizeMaxMindURL(t *testing.T) {
+	permalink := "https://download.maxmind.com/app/geoip_download?edition_id=GeoLite2-City&license_key=KEY&suffix=tar.gz"
+	valid := map[string]string{
+		"https://download.maxmind.com/app/geoip_download?edition_id=GeoLite2-City&license_key=KEY":                   permalink,
+		"https://download.maxmind.com/app/geoip_download?license_key=KEY&suffix=tar.gz&edition_id=GeoLite2-City&x=1": permalink,
+		"https://example.com/GeoLite2-City.mmdb.gz?v=1":                                                              "https://example.com/GeoLite2-City.mmdb.gz?v=1",
+	}
+	for k, v := range valid {
+		u, err := NormalizeMaxMindURL(k)
+		if err != nil {
+			t.Errorf("error normalizing %s: %v", k, err)
+			continue
+		}
+		if u != v {
+			t.Errorf("expecting %s for %s, got %s", v, k, u)
+		}
+	}
+	invalid := []string{
+		"ftp://example.com/GeoLite2-City.mmdb",
+		"http://geolite.maxmind.com/download/geoip/database/GeoLite2-City.mmdb.gz",
+		"https://download.maxmind.com/app/geoip_download_by_token?edition_id=GeoLite2-City&date=20200101&suffix=tar.gz&token=abc",
+	}
+	for _, v := range invalid {
+		if _, err := NormalizeMaxMindURL(v); err == nil {
+			t.Errorf("expecting an error for %s", v)
+		}
+	}
+}
+
+func TestOpenURLs(t *testing.T) {
+	data := readFile(t, "GeoIP2-City-Test.mmdb")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/Invalid.mmdb" {
+			w.Write([]byte("invalid"))
+			return
+		}
+		w.Write(data)
+	}))
+	defer srv.Close()
+	urls := []string{
+		srv.URL + "/GeoIP2-City-Test.mmdb",
+		srv.URL + "/Invalid.mmdb",
+		srv.URL + "/Other.mmdb",
+	}
+	dbs, err := OpenURLs(urls, URLCacheDir(t.TempDir()), URLConcurrency(2))
+	if err == nil {
+		t.Error("expecting an error for invalid database")
+	}
+	if len(dbs) != len(urls) || dbs[0] == nil || dbs[1] != nil || dbs[2] == nil {
+		t.Errorf("unexpected databases %v", dbs)
+	}
+}
+
+// newerDatabase returns a copy of data with its build
+// epoch increased by one second.
+func newerDatabase(t testing.TB, data []byte) []byte {
+	newer := append([]byte(nil), data...)
+	p := bytes.LastIndex(newer, []byte("build_epoch"))
+	if p < 0 {
+		t.Fatal("build_epoch not found")
+	}
+	// extended uint64: control byte with size, type byte, value
+	p += len("build_epoch")
+	size := int(newer[p] & 0x1f)
+	newer[p+2+size-1]++
+	return newer
+}
+
+func TestOpenURLKeepsNewerCache(t *testing.T) {
+	data := readFile(t, "GeoIP2-City-Test.mmdb")
+	srv := testDataServer(t, data)
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "GeoIP2-City-Test.mmdb")
+	newer := newerDatabase(t, data)
+	if err := os.WriteFile(filename, newer, 0644); err != nil {
+		t.Fatal(err)
+	}
+	expired := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(filename, expired, expired); err != nil {
+		t.Fatal(err)
+	}
+	geo, err := OpenURL(srv.URL+"/GeoIP2-City-Test.mmdb", URLCacheDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := New(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !geo.Updated().After(old.Updated()) {
+		t.Errorf("expecting the newer cached database, got one built at %s", geo.Updated())
+	}
+	cached, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cached, newer) {
+		t.Error("newer cached database was replaced")
+	}
+	if st, err := os.Stat(filename); err != nil || !st.ModTime().After(expired) {
+		t.Error("expecting cached database to be marked as fresh")
+	}
+}
+
+func TestCacheUpdated(t *testing.T) {
+	geo := testNewGeoIP(t, "GeoIP2-City-Test.mmdb")
+	if geo == nil {
+		return
+	}
+	o := &urlOptions{CacheDir: "testdata", RejectSymlinks: true}
+	for _, v := range []string{"GeoIP2-City-Test.mmdb", "GeoIP2-City-Test.mmdb.gz"} {
+		updated, err := o.cacheUpdated(filepath.Join("testdata", v))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !updated.Equal(geo.Updated()) {
+			t.Errorf("expecting build time %s for %s, got %s", geo.Updated(), v, updated)
+		}
+	}
+	if _, err := o.cacheUpdated(filepath.Join("testdata", "README.md")); err == nil {
+		t.Error("expecting an error for a file without metadata")
+	}
+}
+
+func TestOpenURLStaleWhileRevalidate(t *testing.T) {
+	data := readFile(t, "GeoIP2-City-Test.mmdb")
+	newer := newerDatabase(t, data)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write(newer)
+	}))
+	t.Cleanup(srv.Close)
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "GeoIP2-City-Test.mmdb")
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	expired := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(filename, expired, expired); err != nil {
+		t.Fatal(err)
+	}
+	geo, err := OpenURL(srv.URL+"/GeoIP2-City-Test.mmdb", URLCacheDir(dir), URLStaleWhileRevalidate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := geo.Updated()
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for !geo.Updated().After(stale) {
+		if time.Now().After(deadline) {
+			t.Fatal("database was not refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := geo.Lookup("81.2.69.160"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOpenURLStaleWhileRevalidateClose(t *testing.T) {
+	requested := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(requested)
+		// Hang until the client gives up
+		<-r.Context().Done()
+	}))
+	t.Cleanup(srv.Close)
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "GeoIP2-City-Test.mmdb")
+	if err := os.WriteFile(filename, readFile(t, "GeoIP2-City-Test.mmdb"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expired := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(filename, expired, expired); err != nil {
+		t.Fatal(err)
+	}
+	geo, err := OpenURL(srv.URL+"/GeoIP2-City-Test.mmdb", URLCacheDir(dir), URLStaleWhileRevalidate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-requested:
+	case <-time.After(5 * time.Second):
+		t.Fatal("database was not refreshed")
+	}
+	closed := make(chan error, 1)
+	go func() { closed <- geo.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not cancel the download in progress")
+	}
+}
+
+func TestResolveURLOptions(t *testing.T) {
+	resolved := ResolveURLOptions("https://download.maxmind.com/app/geoip_download?edition_id=GeoLite2-City&license_key=foo&suffix=tar.gz",
+		URLCacheDir("/tmp/geoip"), URLCacheExpiration(time.Hour))
+	expected := ResolvedOptions{
+		CacheDir:   "/tmp/geoip",
+		CacheFile:  filepath.Join("/tmp/geoip", "GeoLite2-City.mmdb"),
+		Expiration: minimumMaxMindCacheDuration,
+	}
+	if resolved != expected {
+		t.Errorf("expecting %+v, got %+v", expected, resolved)
+	}
+	resolved = ResolveURLOptions("http://example.com/db.mmdb", URLCacheDir("/tmp/geoip"), URLCacheExpiration(time.Hour))
+	if resolved.Expiration != time.Hour || resolved.CacheFile != filepath.Join("/tmp/geoip", "db.mmdb") {
+		t.Errorf("unexpected options %+v", resolved)
+	}
+}
+
+func TestOpenURLProxy(t *testing.T) {
+	data := readFile(t, "GeoIP2-City-Test.mmdb")
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Requests sent to a proxy include the full URL
+		proxied = append(proxied, r.URL.String())
+		w.Write(data)
+	}))
+	t.Cleanup(proxy.Close)
+	const url = "http://geoip.invalid/GeoIP2-City-Test.mmdb"
+	if _, err := OpenURL(url, URLCacheDir(""), URLProxy(proxy.URL)); err != nil {
+		t.Fatal(err)
+	}
+	if len(proxied) != 1 || proxied[0] != url {
+		t.Errorf("expecting a proxied request for %s, got %v", url, proxied)
+	}
+	if _, err := OpenURL(url, URLCacheDir(""), URLProxy("ftp://proxy")); err == nil {
+		t.Error("expecting an error with an unsupported proxy scheme")
+	}
+}
+
+func TestOpenURLClock(t *testing.T) {
+	data := readFile(t, "GeoIP2-City-Test.mmdb")
+	var requests int
+	failing := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if failing {
+			// Not a valid database
+			w.Write([]byte("error"))
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "GeoIP2-City-Test.mmdb")
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(filename, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	url := srv.URL + "/GeoIP2-City-Test.mmdb"
+	for _, v := range []struct {
+		name     string
+		now      time.Time
+		failing  bool
+		requests int
+	}{
+		{"fresh", mtime.Add(time.Hour), false, 0},
+		{"future mtime", mtime.Add(-time.Hour), false, 1},
+		{"expired, download fails", mtime.Add(48 * time.Hour), true, 1},
+	} {
+		requests = 0
+		failing = v.failing
+		now := v.now
+		geo, err := OpenURL(url, URLCacheDir(dir), URLClock(func() time.Time { return now }))
+		if err != nil {
+			t.Errorf("%s: %v", v.name, err)
+			continue
+		}
+		if _, err := geo.Lookup("81.2.69.160"); err != nil {
+			t.Errorf("%s: %v", v.name, err)
+		}
+		if requests != v.requests {
+			t.Errorf("%s: expecting %d requests, got %d", v.name, v.requests, requests)
+		}
+		if err := os.Chtimes(filename, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOpenURLRejectSymlinks(t *testing.T) {
+	data := readFile(t, "GeoIP2-City-Test.mmdb")
+	srv := testDataServer(t, []byte("not a database"))
+	base := t.TempDir()
+	dir := filepath.Join(base, "cache")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(base, "outside.mmdb")
+	if err := os.WriteFile(outside, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "db.mmdb")); err != nil {
+		t.Skip(err)
+	}
+	url := srv.URL + "/db.mmdb"
+	if _, err := OpenURL(url, URLCacheDir(dir)); err != nil {
+		t.Errorf("expecting the symlinked database to be used by default, got %v", err)
+	}
+	if _, err := OpenURL(url, URLCacheDir(dir), URLRejectSymlinks()); err == nil {
+		t.Error("expecting an error when the cached database is a symlink")
+	}
+	if _, err := OpenURL(url, URLCacheDir(dir), URLCacheName("../outside.mmdb")); err != nil {
+		t.Errorf("expecting the database outside of the cache dir to be used by default, got %v", err)
+	}
+	if _, err := OpenURL(url, URLCacheDir(dir), URLCacheName("../outside.mmdb"), URLRejectSymlinks()); err == nil {
+		t.Error("expecting an error when the cached database is outside of the cache dir")
+	}
+	srv = testDataServer(t, data)
+	if _, err := OpenURL(srv.URL+"/db.mmdb", URLCacheDir(dir), URLRejectSymlinks()); err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Lstat(filepath.Join(dir, "db.mmdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode()&os.ModeSymlink != 0 {
+		t.Error("expecting the symlink to be replaced by the cached database")
+	}
+}
+
+func TestOpenURLSkipsIdenticalCache(t *testing.T) {
+	data := readFile(t, "GeoIP2-City-Test.mmdb")
+	srv := testDataServer(t, data)
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "GeoIP2-City-Test.mmdb")
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(filename, expired, expired); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenURL(srv.URL+"/GeoIP2-City-Test.mmdb", URLCacheDir(dir)); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) {
+		t.Error("identical cached database was rewritten")
+	}
+	if !after.ModTime().After(expired) {
+		t.Error("cached database was not marked as fresh")
+	}
+}
+
+func TestOpenURLErrorStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Invalid license key", http.StatusUnauthorized)
+	}))
+	t.Cleanup(srv.Close)
+	_, err := OpenURL(srv.URL+"/app/geoip_download?edition_id=GeoLite2-City&license_key=secret&suffix=tar.gz", URLCacheDir(t.TempDir()))
+	if err == nil {
+		t.Fatal("expecting an error for an unauthorized response")
+	}
+	if strings.Contains(err.Error(), "secret") {
+		t.Errorf("error %q leaks the license key", err)
+	}
+	if !strings.Contains(err.Error(), "401") || !strings.Contains(err.Error(), "Invalid license key") {
+		t.Errorf("error %q does not include the response status and message", err)
+	}
+}
+
+// chanWriter sends each write to the channel, allowing tests
+// to wait for log messages written from other goroutines.
+type chanWriter chan string
+
+func (w chanWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func TestOpenURLRedactsLicenseKey(t *testing.T) {
+	const key = "secret"
+	// Connection errors (*url.Error) include the URL
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	closedURL := closed.URL + "/app/geoip_download?edition_id=GeoLite2-City&license_key=" + key + "&suffix=tar.gz"
+	_, err := OpenURLs([]string{closedURL}, URLCacheDir(""))
+	if err == nil {
+		t.Fatal("expecting an error when the server is down")
+	}
+	if strings.Contains(err.Error(), key) {
+		t.Errorf("error %q leaks the license key", err)
+	}
+	// So do the logged errors when refreshing in the background
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Invalid license key", http.StatusUnauthorized)
+	}))
+	t.Cleanup(srv.Close)
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "GeoIP2-City-Test.mmdb")
+	if err := os.WriteFile(filename, readFile(t, "GeoIP2-City-Test.mmdb"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expired := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(filename, expired, expired); err != nil {
+		t.Fatal(err)
+	}
+	logs := make(chanWriter, 16)
+	geo, err := OpenURL(srv.URL+"/GeoIP2-City-Test.mmdb?license_key="+key, URLCacheDir(dir),
+		URLCacheName("GeoIP2-City-Test.mmdb"), URLStaleWhileRevalidate(),
+		URLDatabaseOpts(ErrorLog(log.New(logs, "", 0))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer geo.Close()
+	select {
+	case msg := <-logs:
+		if !strings.Contains(msg, "error refreshing") {
+			t.Errorf("unexpected log message %q", msg)
+		}
+		if strings.Contains(msg, key) {
+			t.Errorf("log message %q leaks the license key", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("refresh error was not logged")
+	}
+}
+
+func TestLicenseKeyEnv(t *testing.T) {
+	t.Setenv(licenseKeyEnv, "")
+	if _, err := OpenGeoLite(GeoLiteKindCity, URLCacheDir("")); err == nil || !strings.Contains(err.Error(), licenseKeyEnv) {
+		t.Errorf("expecting missing license key error, got %v", err)
+	}
+	t.Setenv(licenseKeyEnv, "foo")
+	if key := newURLOptions(nil).LicenseKey; key != "foo" {
+		t.Errorf("expecting license key foo from the environment, got %q", key)
+	}
+	if key := newURLOptions([]URLOpt{URLLicenseKey("bar")}).LicenseKey; key != "bar" {
+		t.Errorf("expecting license key bar, got %q", key)
+	}
+}
+
+func TestOpenGeoLiteASN(t *testing.T) {
+	data := tarGz(t, "GeoLite2-ASN_20200101/GeoLite2-ASN.mmdb", string(readFile(t, "GeoIP2-City-Test.mmdb")))
+	var requested string
+	client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		requested = r.URL.String()
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Status:     "200 OK",
+			Body:       io.NopCloser(bytes.NewReader(data)),
+			Request:    r,
+		}, nil
+	})}
+	dir := t.TempDir()
+	if _, err := OpenGeoLite(GeoLiteKindASN, URLCacheDir(dir), URLLicenseKey("foo"), URLClient(client)); err != nil {
+		t.Fatal(err)
+	}
+	if expected := maxMindURL("GeoLite2-ASN", "foo", "tar.gz"); requested != expected {
+		t.Errorf("expecting request to %s, got %s", expected, requested)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "GeoLite2-ASN.mmdb")); err != nil {
+		t.Errorf("database was not cached: %v", err)
+	}
+}
+
+func TestOpenURLAutoRefresh(t *testing.T) {
+	defer func(d time.Duration) { minRefreshInterval = d }(minRefreshInterval)
+	minRefreshInterval = 10 * time.Millisecond
+	old := readFile(t, "MaxMind-DB-test-ipv4-24.mmdb")
+	data := readFile(t, "GeoIP2-City-Test.mmdb")
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Write(old)
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+	geo, err := OpenURL(srv.URL+"/GeoIP2-City-Test.mmdb", URLCacheDir(t.TempDir()),
+		URLCacheExpiration(50*time.Millisecond), URLAutoRefresh())
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := geo.Lookup("81.2.69.160"); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("database was not refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := geo.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Closing stops the refreshes
+	n := atomic.LoadInt32(&requests)
+	time.Sleep(200 * time.Millisecond)
+	if m := atomic.LoadInt32(&requests); m != n {
+		t.Errorf("expecting no requests after closing, got %d", m-n)
+	}
+}
+
+func TestOpenURLAutoRefreshClose(t *testing.T) {
+	defer func(d time.Duration) { minRefreshInterval = d }(minRefreshInterval)
+	minRefreshInterval = 10 * time.Millisecond
+	data := readFile(t, "GeoIP2-City-Test.mmdb")
+	var requests int32
+	hanging := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Write(data)
+			return
+		}
+		// Hang until the client gives up
+		if atomic.LoadInt32(&requests) == 2 {
+			close(hanging)
+		}
+		<-r.Context().Done()
+	}))
+	t.Cleanup(srv.Close)
+	geo, err := OpenURL(srv.URL+"/GeoIP2-City-Test.mmdb", URLCacheDir(t.TempDir()),
+		URLCacheExpiration(0), URLAutoRefresh(), URLRetries(3, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-hanging:
+	case <-time.After(5 * time.Second):
+		t.Fatal("database was not refreshed")
+	}
+	closed := make(chan error, 1)
+	go func() { closed <- geo.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close waited for the download in progress")
+	}
+}
+
+func TestOpenURLContext(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Hang until the client gives up
+		<-r.Context().Done()
+	}))
+	t.Cleanup(srv.Close)
+	dir := t.TempDir()
+	url := srv.URL + "/GeoIP2-City-Test.mmdb"
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := OpenURLContext(ctx, url, URLCacheDir(dir)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expecting context.DeadlineExceeded, got %v", err)
+	}
+	// Expired cached databases are used when the context is done
+	filename := filepath.Join(dir, "GeoIP2-City-Test.mmdb")
+	if err := os.WriteFile(filename, readFile(t, "GeoIP2-City-Test.mmdb"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expired := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(filename, expired, expired); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	geo, err := OpenURLContext(ctx, url, URLCacheDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := geo.Lookup("81.2.69.160"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOpenURLTransport(t *testing.T) {
+	data := readFile(t, "GeoIP2-City-Test.mmdb")
+	var requested []string
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		requested = append(requested, r.URL.String())
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(bytes.NewReader(data)),
+			Request:    r,
+		}, nil
+	})
+	const url = "http://geoip.invalid/GeoIP2-City-Test.mmdb"
+	client := &http.Client{Timeout: time.Minute}
+	if _, err := OpenURL(url, URLCacheDir(""), URLClient(client), URLTransport(transport)); err != nil {
+		t.Fatal(err)
+	}
+	if len(requested) != 1 || requested[0] != url {
+		t.Errorf("expecting a request for %s, got %v", url, requested)
+	}
+	if client.Transport != nil {
+		t.Error("URLTransport modified the client")
+	}
+}
+
+func TestOpenURLRetries(t *testing.T) {
+	data := readFile(t, "GeoIP2-City-Test.mmdb")
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&requests, 1) {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.Write(data)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	url := srv.URL + "/GeoIP2-City-Test.mmdb"
+	if _, err := OpenURL(url, URLCacheDir("")); err == nil {
+		t.Error("expecting an error without retries")
+	}
+	atomic.StoreInt32(&requests, 0)
+	if _, err := OpenURL(url, URLCacheDir(""), URLRetries(1, time.Millisecond)); err == nil {
+		t.Error("expecting an error with too few retries")
+	}
+	atomic.StoreInt32(&requests, 0)
+	if _, err := OpenURL(url, URLCacheDir(""), URLRetries(2, time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("expecting 3 requests, got %d", n)
+	}
+	// Client errors are not retried
+	atomic.StoreInt32(&requests, 0)
+	notFound := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(notFound.Close)
+	if _, err := OpenURL(notFound.URL+"/db.mmdb", URLCacheDir(""), URLRetries(3, time.Millisecond)); err == nil {
+		t.Error("expecting an error for a missing database")
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("expecting 1 request, got %d", n)
+	}
+}
+
+func TestOpenURLRetryAfterCapped(t *testing.T) {
+	defer func(d time.Duration) { maxRetryDelay = d }(maxRetryDelay)
+	maxRetryDelay = 10 * time.Millisecond
+	data := readFile(t, "GeoIP2-City-Test.mmdb")
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", "86400")
+			http.Error(w, "try again tomorrow", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := OpenURLContext(ctx, srv.URL+"/GeoIP2-City-Test.mmdb", URLCacheDir(""), URLRetries(1, time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRetryableIfTransient(t *testing.T) {
+	retryable := []error{
+		&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("no route to host")},
+		&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)},
+		fmt.Errorf("wrapped: %w", syscall.ECONNREFUSED),
+	}
+	for _, v := range retryable {
+		var rerr *retryableError
+		if !errors.As(retryableIfTransient(v), &rerr) {
+			t.Errorf("expecting %v to be retryable", v)
+		}
+	}
+	if err := errors.New("invalid"); retryableIfTransient(err) != err {
+		t.Errorf("expecting %v not to be retryable", err)
+	}
+	// Connection refused, against a real closed port
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	_, err := http.Get(closed.URL)
+	var rerr *retryableError
+	if !errors.As(retryableIfTransient(err), &rerr) {
+		t.Errorf("expecting %v to be retryable", err)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	if d := retryAfter("120"); d != 2*time.Minute {
+		t.Errorf("expecting 2m, got %s", d)
+	}
+	if d := retryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("expecting ~1h, got %s", d)
+	}
+	for _, v := range []string{"", "-1", "invalid"} {
+		if d := retryAfter(v); d != 0 {
+			t.Errorf("expecting 0 for %q, got %s", v, d)
+		}
+	}
+}
+
+func TestOpenURLConditional(t *testing.T) {
+	data := readFile(t, "GeoIP2-City-Test.mmdb")
+	const etag = `"v1"`
+	var downloads, notModified int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		downloads++
+		w.Header().Set("ETag", etag)
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+	dir := t.TempDir()
+	url := srv.URL + "/GeoIP2-City-Test.mmdb"
+	if _, err := OpenURL(url, URLCacheDir(dir)); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "GeoIP2-City-Test.mmdb")
+	expired := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(filename, expired, expired); err != nil {
+		t.Fatal(err)
+	}
+	geo, err := OpenURL(url, URLCacheDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := geo.Lookup("81.2.69.160"); err != nil {
+		t.Error(err)
+	}
+	if downloads != 1 || notModified != 1 {
+		t.Errorf("expecting 1 download and 1 not modified response, got %d and %d", downloads, notModified)
+	}
+	st, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.ModTime().After(expired) {
+		t.Error("cached database was not marked as fresh")
+	}
+	// Without validators, the database is downloaded again
+	if err := os.Remove(validatorsFile(filename)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filename, expired, expired); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenURL(url, URLCacheDir(dir)); err != nil {
+		t.Fatal(err)
+	}
+	if downloads != 2 {
+		t.Errorf("expecting 2 downloads, got %d", downloads)
+	}
+}
@@ -0,0 +1,95 @@
+package geoip
+
+import (
+	"context"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDelay is the time waited after the last change to a watched
+// file before reloading it, so files written in several steps are
+// only reloaded once they're complete.
+var watchDelay = 500 * time.Millisecond
+
+// WatchFile makes databases opened with Open or OpenMmap watch their
+// file for changes and reload it (see GeoIP.Reload) when it's replaced
+// or modified, e.g. by geoipupdate or a cron job. After each reload,
+// fn is called with its error, if any, so callers can log failures or
+// track the updates. When a reload fails, the previous database is
+// kept. Since the directory of the file is watched, files replaced
+// with a rename are also detected. The watcher runs until the GeoIP
+// is closed with GeoIP.Close. fn might be nil. fn might call
+// GeoIP.Close, in which case Close returns without waiting for fn to
+// finish. This option is ignored by the functions which don't open a
+// file by its name.
+func WatchFile(fn func(err error)) Opt {
+	return func(opts *options) {
+		opts.watchFile = true
+		opts.watchFunc = fn
+	}
+}
+
+// watch starts watching filename, which must be the file in
+// g.source, if WatchFile was used.
+func (g *GeoIP) watch(filename string) error {
+	if !g.opts.watchFile {
+		return nil
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(filename)); err != nil {
+		watcher.Close()
+		return err
+	}
+	done := make(chan struct{})
+	// Set while calling watchFunc, which might close g. Waiting
+	// for done in that case would deadlock.
+	var inCallback atomic.Bool
+	g.onClose(func() {
+		watcher.Close()
+		if !inCallback.Load() {
+			<-done
+		}
+	})
+	go func() {
+		defer close(done)
+		name := filepath.Clean(filename)
+		timer := time.NewTimer(watchDelay)
+		timer.Stop()
+		defer timer.Stop()
+		for {
+			select {
+			case ev, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(ev.Name) == name && (ev.Has(fsnotify.Create) || ev.Has(fsnotify.Write)) {
+					timer.Reset(watchDelay)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				g.logf("geoip: error watching %s: %v", filename, err)
+			case <-timer.C:
+				err := g.reloadSource(context.Background())
+				if err == ErrClosed {
+					return
+				}
+				if fn := g.opts.watchFunc; fn != nil {
+					inCallback.Store(true)
+					fn(err)
+					inCallback.Store(false)
+				} else if err != nil {
+					g.logf("geoip: error reloading %s: %v", filename, err)
+				}
+			}
+		}
+	}()
+	return nil
+}